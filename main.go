@@ -1,313 +1,732 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"strings"
 
 	humanize "github.com/dustin/go-humanize"
+	"github.com/fasterthanlime/otto/ottolib"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
 
-	"encoding/json"
+var (
+	app                 = kingpin.New("otto", "An autotools hater")
+	profileArg          = app.Flag("profile", "Profiles to build, by name or pattern (release*), comma-separated or repeated").Strings()
+	resumeArg           = app.Flag("resume", "Which package to resume the build at").String()
+	srcLayoutArg        = app.Flag("src-layout", "Where package sources go, as a Go template using {{.OutDir}}, {{.Profile}} and {{.Package}}").PlaceHolder(ottolib.DefaultSrcLayout).String()
+	prefixLayoutArg     = app.Flag("prefix-layout", "Where profile prefixes go, as a Go template using {{.OutDir}} and {{.Profile}}").PlaceHolder(ottolib.DefaultPrefixLayout).String()
+	relocateToArg       = app.Flag("relocate-to", "Once a profile is built, rewrite references to its prefix (in .pc, .la, *-config files and rpaths) to this path, where it'll be deployed ($PROFILE is replaced with the profile's name)").String()
+	prefixModeArg       = app.Flag("prefix-mode", "What to do with a prefix that isn't empty: reuse it, clean it first, or fail (default: the profile's PrefixMode, or reuse)").Enum("reuse", "clean", "fail")
+	resumeProfileArg    = app.Flag("resume-profile", "Which profile to resume the build at (--resume then applies to that profile only)").String()
+	concurrencyLevelArg = app.Flag("concurrency", "The N in -jN to pass to make").Short('j').Default("2").Int()
+	retrySerialArg      = app.Flag("retry-serial", "Retry a failed make once with -j1").Bool()
+	maxLoadArg          = app.Flag("max-load", "Wait before building each package until the load average is below this (Linux only)").Float64()
+	downloadRetriesArg  = app.Flag("download-retries", "How many times to retry a failed or corrupt download").Default("1").Int()
+	maxRedirectsArg     = app.Flag("max-redirects", "How many redirects to follow per download (0 for none)").Default("10").Int()
+	noCrossHostArg      = app.Flag("no-cross-host-redirect", "Refuse download redirects to a different host").Bool()
+	connectTimeoutArg   = app.Flag("connect-timeout", "Give up connecting to a server after this long (e.g. 10s)").Default("30s").Duration()
+	cacheDirArg         = app.Flag("cache-dir", "Keep downloaded archives in this directory, shared by all builds whatever their outdir").String()
+	allowedHostsArg     = app.Flag("allowed-hosts", "Only download from these hosts (or host patterns like *.example.org), can be repeated").Strings()
+	forceDownloadArg    = app.Flag("force-download", "Download archives again even if they're already there with the right checksum").Bool()
+	maxPerHostArg       = app.Flag("max-per-host-downloads", "How many archives to download at once from any one host (0 for no limit)").Default("0").Int()
+	allowNonArchivesArg = app.Flag("allow-non-archives", "Keep downloads that look like web pages or text instead of failing them as not archives").Bool()
+	checksumFileArg     = app.Flag("checksum-file", "Record checksums of archives that have none in this file on first download, and verify them from then on").String()
+	userAgentArg        = app.Flag("user-agent", "User-Agent to download with (default otto/<version>)").String()
+	hostUserAgentArg    = app.Flag("host-user-agent", "User-Agent to download from some host with, as host=agent, can be repeated (host can be a pattern like *.example.org)").StringMap()
+	readTimeoutArg      = app.Flag("read-timeout", "Give up on a download when nothing is received for this long, 0 to wait forever (e.g. 2m)").Default("0").Duration()
+	maxArchiveSizeArg   = app.Flag("max-archive-size", "Abort downloads bigger than this (e.g. 500MB)").String()
+	sourceDirArg        = app.Flag("source-dir", "Directory of pre-downloaded archives to use instead of downloading").String()
+	tarArg              = app.Flag("tar", "tar binary to extract with (default: gtar, tar or bsdtar, whichever is found first)").String()
+	nativeExtractArg    = app.Flag("native-extract", "Extract archives with otto's own tar implementation instead of a tar binary").Bool()
+	offlineArg          = app.Flag("offline", "Never download, only use archives already in the outdir (or --source-dir)").Bool()
+	assertNoNetworkArg  = app.Flag("assert-no-network", "Fail packages whose configure, build or install tries to access the network (through the proxy variables they get)").Bool()
+	extractJobsArg      = app.Flag("extract-jobs", "How many packages to download and extract ahead of the build (0 to disable)").Default("0").Int()
+	prefixOutputArg     = app.Flag("prefix-output", "Prefix every line of build output with [profile/package]").Bool()
+	explainArg          = app.Flag("explain", "Print why each package will be built or skipped").Bool()
+	dryRunArg           = app.Flag("dry-run", "Only show what would be built, do not build anything").Bool()
+	plainJSONArg        = app.Flag("plain-json", "Never compress manifests and state files").Bool()
+	upstreamNamesArg    = app.Flag("upstream-filenames", "Name downloaded archives after their URL instead of <package>.<format>").Bool()
+	verifyExtractArg    = app.Flag("verify-extract", "Record how many files each archive has, and fail if that changes").Bool()
+	strictOverwritesArg = app.Flag("strict-overwrites", "Fail packages that overwrite files other packages installed, instead of warning").Bool()
+	strictConfigureArg  = app.Flag("strict-configure", "Fail packages whose configure script doesn't recognize some of their options").Bool()
+	reportFeaturesArg   = app.Flag("report-features", "Say which optional features configure enabled or disabled, and put them in the report").Bool()
+	dumpConfigArg       = app.Flag("dump-config", "Print the fully resolved config as JSON and exit").Bool()
+	failFastArg         = app.Flag("fail-fast", "Stop at the first package that fails (use --no-fail-fast to carry on)").Default("true").Bool()
+	enforceEnvFpArg     = app.Flag("enforce-env-fingerprint", "Fail if tool versions or build variables changed since the profile was first built, instead of warning").Bool()
+	deadlineArg         = app.Flag("deadline", "Stop building new packages after this long (e.g. 50m), and exit with code 12 once state is written").Duration()
+	deadlineGraceArg    = app.Flag("deadline-grace", "How long packages still building past --deadline get before they're killed").Default("2m").Duration()
+	repairArg           = app.Flag("repair", "Only rebuild packages that look broken in the prefix (never built, or with installed files missing), and their dependents").Bool()
+	keepGoingArg        = app.Flag("keep-going", "Carry on building other packages when one fails, like --no-fail-fast").Short('k').Bool()
+	tagArg              = app.Flag("tag", "Only build packages with this tag, can be repeated").Strings()
+	changedSinceArg     = app.Flag("changed-since", "Only build packages whose definition changed in the config since this git revision, and their dependents").String()
+	withDepsArg         = app.Flag("with-deps", "Also build the deps of packages selected by --tag").Bool()
+	prefixPerPkgArg     = app.Flag("prefix-per-package", "Install each package into its own prefix, <prefix>/pkgs/<name>").Bool()
+	mergePrefixArg      = app.Flag("merge-prefix", "With --prefix-per-package, union all package prefixes into <prefix>/merged").Bool()
+	storeDirArg         = app.Flag("store-dir", "Install each package into a store path named by a hash of its inputs, reused when they don't change, and link them all into the prefix").String()
+	sourceEpochArg      = app.Flag("source-date-epoch", "Set SOURCE_DATE_EPOCH to this Unix timestamp when building").Int64()
+	disabledDepsArg     = app.Flag("disabled-deps", "What to do with packages depending on a disabled one: skip them, or fail right away").Default("skip").Enum("skip", "fail")
+	scheduleArg         = app.Flag("schedule", "Build order: lpt for the slowest packages (from previous runs) first, or order for dependency order").Default("order").Enum("order", "lpt")
+	noPrefixPathArg     = app.Flag("no-prefix-path", "Don't prepend <prefix>/bin to PATH when building").Bool()
+	statsArg            = app.Flag("stats", "Print a summary of the run when it completes").Bool()
+	outputFormatArg     = app.Flag("output-format", "Write a report of the run in this format (text, json, yaml)").Enum("text", "json", "yaml")
+	reportFileArg       = app.Flag("report-file", "Write the report to this file instead of stdout").String()
+	metricsFileArg      = app.Flag("metrics-file", "Write metrics about the build to this file, in the Prometheus textfile collector format").String()
+	metricsPushArg      = app.Flag("metrics-push", "Push metrics about the build to this Prometheus Pushgateway (e.g. http://pushgateway:9091)").String()
+	sbomArg             = app.Flag("sbom", "Write a software bill of materials of the packages built to this file").String()
+	sbomFormatArg       = app.Flag("sbom-format", "Format of the --sbom (cyclonedx or spdx)").Default("cyclonedx").Enum("cyclonedx", "spdx")
+	provenanceArg       = app.Flag("provenance", "Write SLSA provenance (an in-toto statement) of the packages built to this file").String()
+	sandboxArg          = app.Flag("sandbox", "Run configure, make and make install in a bwrap sandbox that only sees the outdir and prefix (Linux)").Bool()
+	sandboxAllowArg     = app.Flag("sandbox-allow", "Path to make visible (read-only) in the sandbox, can be repeated").Strings()
+	colorArg            = app.Flag("color", "Color log levels (default: only on a terminal, unless NO_COLOR is set)").Action(setColor).Bool()
+	logFileArg          = app.Flag("log-file", "Also write all output, including that of the commands run, to this file").String()
+	logMaxSizeArg       = app.Flag("log-max-size", "Rotate the log file once it gets bigger than this (0 to never rotate)").Default("10MB").String()
+	logMaxFilesArg      = app.Flag("log-max-files", "How many rotated log files to keep").Default("5").Int()
+
+	// colorSet is true if --color or --no-color was given explicitly
+	colorSet bool
+	// logFile is the --log-file, if any
+	logFile io.Writer
+
+	buildCmd       = app.Command("build", "Build all packages").Default()
+	configPath     = buildCmd.Arg("config", "Path to JSON config file").Required().String()
+	outDirArg      = buildCmd.Arg("outdir", "Output dir").Required().String()
+	standaloneFlag = buildCmd.Flag("standalone", "Build only the package given by --only (and its deps) into a fresh prefix").Bool()
+	watchFlag      = buildCmd.Flag("watch", "After building, rebuild packages with local (file://) sources when they change, and their dependents").Bool()
+	debounceArg    = buildCmd.Flag("debounce", "With --watch, how long changes have to settle before rebuilding").Default("500ms").Duration()
+	onlyArg        = buildCmd.Flag("only", "Package to build with --standalone").String()
+
+	buildOneCmd        = app.Command("build-one", "Build a single package and its deps into a fresh prefix")
+	buildOneConfigPath = buildOneCmd.Arg("config", "Path to JSON config file").Required().String()
+	buildOnePackageArg = buildOneCmd.Arg("package", "Name of the package to build").Required().String()
+	buildOneOutDirArg  = buildOneCmd.Arg("outdir", "Output dir (defaults to a temporary directory)").String()
+
+	scriptCmd        = app.Command("script", "Print a bash script that builds what build would, without otto")
+	scriptConfigPath = scriptCmd.Arg("config", "Path to JSON config file").Required().String()
+	scriptOutDirArg  = scriptCmd.Arg("outdir", "Output dir").Required().String()
+
+	fetchCmd        = app.Command("fetch", "Download and verify archives into a directory without building")
+	fetchConfigPath = fetchCmd.Arg("config", "Path to JSON config file").Required().String()
+	fetchDirArg     = fetchCmd.Arg("dir", "Directory to download archives into").Required().String()
+	fetchOnlyArg    = fetchCmd.Flag("only", "Only fetch this package (and its deps), can be repeated").Strings()
+
+	checkURLsCmd        = app.Command("check-urls", "Check that every source and mirror URL is reachable, with HEAD requests")
+	checkURLsConfigPath = checkURLsCmd.Arg("config", "Path to JSON config file").Required().String()
+	checkURLsOnlyArg    = checkURLsCmd.Flag("only", "Only check this package (and its deps), can be repeated").Strings()
+
+	listCmd        = app.Command("list", "List the packages in a config")
+	listConfigPath = listCmd.Arg("config", "Path to JSON config file").Required().String()
+	listTagsFlag   = listCmd.Flag("tags", "List the tags in use instead").Bool()
+
+	validateCmd        = app.Command("validate", "Check a config, and warn about contradicting or duplicate configure args")
+	validateConfigPath = validateCmd.Arg("config", "Path to JSON config file").Required().String()
+	validateStrictFlag = validateCmd.Flag("strict", "Fail if there are any warnings").Bool()
+
+	graphCmd        = app.Command("graph", "Print the dependency graph in Graphviz DOT format")
+	graphConfigPath = graphCmd.Arg("config", "Path to JSON config file").Required().String()
+	graphListFlag   = graphCmd.Flag("list", "Print packages in build order instead").Bool()
+)
 
-	"net/http"
+func main() {
+	log.SetFlags(ottolib.LogFlags)
 
-	"strings"
+	cmd, err := app.Parse(os.Args[1:])
+	if err != nil {
+		ctx, _ := app.ParseContext(os.Args[1:])
+		app.FatalUsageContext(ctx, "%s\n", err.Error())
+	}
 
-	"os/exec"
+	if *logFileArg != "" {
+		openLogFile()
+	}
 
-	"gopkg.in/alecthomas/kingpin.v2"
-)
+	switch cmd {
+	case buildCmd.FullCommand():
+		if *standaloneFlag {
+			if *onlyArg == "" {
+				app.FatalUsage("--standalone needs --only to know which package to build\n")
+			}
+			doBuildOne(*configPath, *onlyArg, *outDirArg)
+		} else if *watchFlag {
+			doWatch(*configPath, *outDirArg)
+		} else {
+			doBuild(*configPath, *outDirArg)
+		}
+	case buildOneCmd.FullCommand():
+		doBuildOne(*buildOneConfigPath, *buildOnePackageArg, *buildOneOutDirArg)
+	case scriptCmd.FullCommand():
+		doScript(*scriptConfigPath, *scriptOutDirArg)
+	case fetchCmd.FullCommand():
+		doFetch(*fetchConfigPath, *fetchDirArg)
+	case checkURLsCmd.FullCommand():
+		doCheckURLs(*checkURLsConfigPath)
+	case listCmd.FullCommand():
+		doList(*listConfigPath)
+	case validateCmd.FullCommand():
+		doValidate(*validateConfigPath)
+	case graphCmd.FullCommand():
+		doGraph(*graphConfigPath)
+	}
+}
 
-type Config struct {
-	Profiles []*Profile
-	Packages []*Package
+func setColor(*kingpin.ParseContext) error {
+	colorSet = true
+	return nil
 }
 
-type Profile struct {
-	Name      string
-	Env       map[string]string
-	Configure []string
-	Pkgconfig []string
+// useColor reports whether stderr output should be colored,
+// according to --color or the terminal
+func useColor() bool {
+	if colorSet {
+		return *colorArg
+	}
+	return ottolib.ColorEnabled(os.Stderr)
 }
 
-type Package struct {
-	Name               string
-	Env                map[string]string
-	Sources            string
-	Format             string
-	Configure          []string
-	ConfigureBlacklist []string
+// openLogFile opens the --log-file, and sends everything the log
+// package prints there as well
+func openLogFile() {
+	maxSize, err := humanize.ParseBytes(*logMaxSizeArg)
+	if err != nil {
+		app.FatalUsage("Invalid --log-max-size: %s\n", err.Error())
+	}
+
+	f, err := ottolib.OpenRotatingFile(*logFileArg, int64(maxSize), *logMaxFilesArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logFile = f
+	log.SetOutput(io.MultiWriter(os.Stderr, logFile))
 }
 
-type Blacklist struct {
-	Prefixes []string
+// newBuilder returns a builder for config that logs to stderr,
+// and to the --log-file if there's one
+func newBuilder(config *ottolib.Config) *ottolib.Builder {
+	builder := ottolib.NewBuilder(config)
+	builder.Logger = ottolib.NewColorLogger(os.Stderr, useColor())
+	if logFile != nil {
+		builder.Logger = ottolib.MultiLogger(builder.Logger, ottolib.NewColorLogger(logFile, false))
+		builder.Stdout = io.MultiWriter(os.Stdout, logFile)
+		builder.Stderr = io.MultiWriter(os.Stderr, logFile)
+	}
+	return builder
 }
 
-func (bl *Blacklist) Has(s string) bool {
-	for _, p := range bl.Prefixes {
-		if strings.HasPrefix(s, p) {
-			return true
+func downloadOptions() ottolib.DownloadOptions {
+	opts := ottolib.DownloadOptions{
+		Retries: *downloadRetriesArg,
+
+		MaxRedirects:        *maxRedirectsArg,
+		NoCrossHostRedirect: *noCrossHostArg,
+
+		MaxPerHost:     *maxPerHostArg,
+		ConnectTimeout: *connectTimeoutArg,
+		ReadTimeout:    *readTimeoutArg,
+		CacheDir:       *cacheDirArg,
+
+		UserAgent:      *userAgentArg,
+		HostUserAgents: *hostUserAgentArg,
+		AllowedHosts:   *allowedHostsArg,
+		ChecksumFile:   *checksumFileArg,
+		ForceDownload:  *forceDownloadArg,
+
+		AllowNonArchives: *allowNonArchivesArg,
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = defaultUserAgent()
+	}
+	if *maxRedirectsArg == 0 {
+		opts.MaxRedirects = -1
+	}
+
+	if *maxArchiveSizeArg != "" {
+		maxSize, err := humanize.ParseBytes(*maxArchiveSizeArg)
+		if err != nil {
+			app.FatalUsage("Invalid --max-archive-size: %s\n", err.Error())
 		}
+		opts.MaxArchiveSize = int64(maxSize)
 	}
-	return false
-}
 
-var (
-	app                 = kingpin.New("otto", "An autotools hater")
-	configPath          = app.Arg("config", "Path to JSON config file").Required().String()
-	outDirArg           = app.Arg("outdir", "Output dir").Required().String()
-	profileArg          = app.Flag("profile", "Profile to build").String()
-	resumeArg           = app.Flag("resume", "Which package to resume the build at").String()
-	concurrencyLevelArg = app.Flag("concurrency", "The N in -jN to pass to make").Short('j').Default("2").String()
-)
+	return opts
+}
 
-func main() {
-	makeConcurrencyFlag := "-j" + (*concurrencyLevelArg)
+// defaultUserAgent is otto/<version>, for binaries that know their
+// version (go install'd ones), or just otto
+func defaultUserAgent() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return ottolib.DefaultUserAgent
+	}
+	return ottolib.DefaultUserAgent + "/" + info.Main.Version
+}
 
-	_, err := app.Parse(os.Args[1:])
+// loadConfig loads the config or dies trying. With --dump-config,
+// it prints the resolved config and exits instead of returning.
+func loadConfig(configPath string) *ottolib.Config {
+	config, err := ottolib.LoadConfig(configPath)
 	if err != nil {
-		ctx, _ := app.ParseContext(os.Args[1:])
-		app.FatalUsageContext(ctx, "%s\n", err.Error())
+		log.Print(err)
+		os.Exit(ottolib.ExitCode(ottolib.FailureConfig))
 	}
 
-	configBytes, err := ioutil.ReadFile(*configPath)
-	if err != nil {
-		log.Fatal("While reading config", err)
+	if *dumpConfigArg {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	return config
+}
+
+func buildOptions(outDir string) ottolib.BuildOptions {
+	if *mergePrefixArg && !*prefixPerPkgArg {
+		app.FatalUsage("--merge-prefix only makes sense with --prefix-per-package\n")
+	}
+	if *relocateToArg != "" && !filepath.IsAbs(*relocateToArg) {
+		app.FatalUsage("--relocate-to needs an absolute path\n")
+	}
+	if *storeDirArg != "" && *prefixPerPkgArg {
+		app.FatalUsage("--store-dir and --prefix-per-package don't mix, the store already has a prefix per package\n")
 	}
 
-	var config Config
-	err = json.Unmarshal(configBytes, &config)
+	return ottolib.BuildOptions{
+		OutDir:        outDir,
+		Profiles:      *profileArg,
+		Resume:        *resumeArg,
+		ResumeProfile: *resumeProfileArg,
+		PrefixMode:    *prefixModeArg,
+		RelocateTo:    *relocateToArg,
+		SrcLayout:     *srcLayoutArg,
+		PrefixLayout:  *prefixLayoutArg,
+		KeepGoing:     *keepGoingArg || !*failFastArg,
+		Repair:        *repairArg,
+		Deadline:      *deadlineArg,
+		DeadlineGrace: *deadlineGraceArg,
+		Tags:          *tagArg,
+		WithDeps:      *withDepsArg,
+		Schedule:      *scheduleArg,
+		DisabledDeps:  *disabledDepsArg,
+
+		PrefixPerPackage: *prefixPerPkgArg,
+		MergePrefix:      *mergePrefixArg,
+		StoreDir:         *storeDirArg,
+		SourceDateEpoch:  *sourceEpochArg,
+
+		NoPrefixPath: *noPrefixPathArg,
+		MakeJobs:     *concurrencyLevelArg,
+		MaxLoad:      *maxLoadArg,
+		RetrySerial:  *retrySerialArg,
+		Download:     downloadOptions(),
+		SourceDir:    *sourceDirArg,
+		Offline:      *offlineArg,
+		ExtractJobs:  *extractJobsArg,
+		Tar:          *tarArg,
+
+		NativeExtract: *nativeExtractArg,
+		PrefixOutput:  *prefixOutputArg,
+		Sandbox:       *sandboxArg,
+		SandboxPaths:  *sandboxAllowArg,
+		VerifyExtract: *verifyExtractArg,
+
+		UpstreamFilenames: *upstreamNamesArg,
+		PlainJSON:         *plainJSONArg,
+		StrictConfigure:   *strictConfigureArg,
+		ReportFeatures:    *reportFeaturesArg,
+		StrictOverwrites:  *strictOverwritesArg,
+		AssertNoNetwork:   *assertNoNetworkArg,
+
+		EnforceEnvFingerprint: *enforceEnvFpArg,
+	}
+}
+
+// changedPackages returns the packages that changed since --changed-since,
+// and their dependents. If there are none, there's nothing to build.
+func changedPackages(configPath string, config *ottolib.Config) []string {
+	old, err := ottolib.LoadConfigAt(configPath, *changedSinceArg)
 	if err != nil {
-		log.Fatal("While parsing config", err)
+		log.Fatal(err)
 	}
 
-	outDir, err := filepath.Abs(*outDirArg)
+	changed, err := config.ChangedSince(old)
 	if err != nil {
-		log.Fatal("While absolutizing outDir", err)
+		log.Fatal(err)
 	}
 
-	log.Printf("Config: %#v", config)
-	for _, profile := range config.Profiles {
-		if *profileArg != "" && *profileArg != profile.Name {
-			log.Println("Skipping", profile.Name)
-			continue
-		}
+	if len(changed) == 0 {
+		log.Printf("No packages changed since %s, nothing to build", *changedSinceArg)
+		os.Exit(0)
+	}
+	log.Printf("Changed since %s: %s", *changedSinceArg, strings.Join(changed, ", "))
+	return changed
+}
+
+func runBuild(configPath string, opts ottolib.BuildOptions) *ottolib.Result {
+	config := loadConfig(configPath)
 
-		log.Println("Dealing with profile", profile.Name)
+	builder := newBuilder(config)
+	builder.Logger.Debugf("Config: %#v", config)
 
-		src := filepath.Join(outDir, "src", profile.Name)
-		prefix := filepath.Join(outDir, profile.Name)
+	if *changedSinceArg != "" {
+		opts.Packages = append(opts.Packages, changedPackages(configPath, config)...)
+	}
 
-		err = os.MkdirAll(src, 0755)
+	if *explainArg || *dryRunArg {
+		plans, err := builder.Plan(opts)
 		if err != nil {
-			log.Fatal("While creating source directory", err)
+			log.Print(err)
+			os.Exit(ottolib.ExitCode(ottolib.FailureConfig))
 		}
+		printPlan(plans)
 
-		err = os.MkdirAll(prefix, 0755)
-		if err != nil {
-			log.Fatal("While creating prefix directory", err)
+		if *dryRunArg {
+			os.Exit(0)
 		}
+	}
+
+	res, err := builder.Build(context.Background(), opts)
 
-		expand := func(s string) string {
-			res := strings.Replace(s, "$PREFIX", prefix, -1)
-			return res
+	// on failure, always say what got built and what broke
+	if *statsArg || err != nil {
+		res.PrintSummary(os.Stderr)
+	}
+
+	if *outputFormatArg != "" || *reportFileArg != "" {
+		reportErr := writeReport(res, err)
+		if reportErr != nil {
+			log.Printf("While writing report: %s", reportErr)
 		}
+	}
 
-		skipping := false
-		if *resumeArg != "" {
-			skipping = true
+	if *metricsFileArg != "" {
+		metricsErr := writeMetrics(res, err)
+		if metricsErr != nil {
+			log.Printf("While writing metrics: %s", metricsErr)
+		}
+	}
+	if *metricsPushArg != "" {
+		metricsErr := res.PushMetrics(*metricsPushArg, err)
+		if metricsErr != nil {
+			log.Printf("While pushing metrics: %s", metricsErr)
 		}
+	}
 
-		for _, pkg := range config.Packages {
-			if pkg.Name == *resumeArg {
-				skipping = false
-			}
+	if *sbomArg != "" {
+		sbomErr := writeSBOM(builder, res)
+		if sbomErr != nil {
+			log.Printf("While writing SBOM: %s", sbomErr)
+		}
+	}
 
-			if skipping {
-				log.Println("Skipping", pkg.Name)
-				continue
-			}
+	if *provenanceArg != "" {
+		provenanceErr := writeProvenance(builder, res)
+		if provenanceErr != nil {
+			log.Printf("While writing provenance: %s", provenanceErr)
+		}
+	}
 
-			log.Println("Preparing", pkg.Name)
-			env := []string{}
-			for k, v := range profile.Env {
-				env = append(env, fmt.Sprintf("%s=%s", k, expand(v)))
-			}
-			for k, v := range pkg.Env {
-				env = append(env, fmt.Sprintf("%s=%s", k, expand(v)))
-			}
-			env = append(env, fmt.Sprintf("PREFIX=%s", prefix))
+	if err != nil {
+		// CI tells transient failures from the others by this
+		log.Print(err)
+		os.Exit(ottolib.ExitCode(res.FailureCategory(err)))
+	}
 
-			pkgConfig := fmt.Sprintf("%s/lib/pkgconfig", prefix)
-			for _, v := range profile.Pkgconfig {
-				pkgConfig = fmt.Sprintf("%s:%s", pkgConfig, v)
-			}
-			env = append(env, fmt.Sprintf("PKG_CONFIG_PATH=%s", pkgConfig))
+	return res
+}
 
-			pkgSrc := filepath.Join(src, pkg.Name)
-			err = os.MkdirAll(pkgSrc, 0755)
-			if err != nil {
-				log.Fatal("While package source directory", err)
-			}
+func printPlan(plans []*ottolib.ProfilePlan) {
+	for _, pp := range plans {
+		fmt.Printf("%s: %s\n", pp.Profile.Name, pp)
+		for _, d := range pp.Packages {
+			fmt.Printf("  %s/%s: %s\n", pp.Profile.Name, d.Package.Name, d)
+		}
+	}
+}
 
-			log.Println("Downloading from", pkg.Sources)
+func writeReport(res *ottolib.Result, buildErr error) error {
+	if *reportFileArg == "" {
+		return res.WriteReport(os.Stdout, *outputFormatArg, buildErr)
+	}
 
-			format := pkg.Format
-			if format == "" {
-				if strings.Contains(pkg.Sources, ".tar.xz") {
-					format = "tar.xz"
-				} else if strings.Contains(pkg.Sources, ".tar.gz") {
-					format = "tar.gz"
-				} else {
-					log.Fatal("Could not figure out format of", pkg.Sources, "please specify explicitly")
-				}
-			}
+	f, err := os.Create(*reportFileArg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-			pkgArchive := filepath.Join(pkgSrc, fmt.Sprintf("%s.%s", pkg.Name, format))
-			pkgWriter, err := os.Create(pkgArchive)
-			if err != nil {
-				log.Fatal(err)
-			}
+	err = res.WriteReport(f, *outputFormatArg, buildErr)
+	if err != nil {
+		return err
+	}
 
-			res, err := http.Get(pkg.Sources)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer res.Body.Close()
+	return f.Close()
+}
 
-			if res.StatusCode != 200 {
-				log.Fatal("HTTP", res.StatusCode, "for", pkg.Sources)
-			}
+// writeMetrics writes to a temporary file that then replaces the metrics
+// file, so that the textfile collector never reads half of it
+func writeMetrics(res *ottolib.Result, buildErr error) error {
+	tmp := *metricsFileArg + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
 
-			humanSize := "? bytes"
-			if res.ContentLength > 0 {
-				humanSize = humanize.IBytes(uint64(res.ContentLength))
-			}
-			log.Println("Downloading", humanSize)
+	err = res.WriteMetrics(f, buildErr)
+	if err != nil {
+		return err
+	}
 
-			_, err = io.Copy(pkgWriter, res.Body)
-			if err != nil {
-				log.Fatal("While downloading", err)
-			}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, *metricsFileArg)
+}
 
-			err = pkgWriter.Close()
-			if err != nil {
-				log.Fatal(err)
-			}
+func writeSBOM(builder *ottolib.Builder, res *ottolib.Result) error {
+	f, err := os.Create(*sbomArg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-			log.Printf("Extracting...")
-			tarFlags, err := tarFlagsForFormat(format)
-			if err != nil {
-				log.Fatal(err)
-			}
+	err = builder.WriteSBOM(f, *sbomFormatArg, res)
+	if err != nil {
+		return err
+	}
 
-			err = command("tar", env, tarFlags, pkgArchive, "-C", pkgSrc)
-			if err != nil {
-				log.Fatal(err)
-			}
+	return f.Close()
+}
 
-			files, err := ioutil.ReadDir(pkgSrc)
-			if err != nil {
-				log.Fatal(err)
-			}
+func writeProvenance(builder *ottolib.Builder, res *ottolib.Result) error {
+	f, err := os.Create(*provenanceArg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-			var dir os.FileInfo
-			for _, f := range files {
-				if f.IsDir() {
-					dir = f
-					break
-				}
-			}
+	err = builder.WriteProvenance(f, res)
+	if err != nil {
+		return err
+	}
 
-			baseWd, err := os.Getwd()
+	return f.Close()
+}
+
+func doBuild(configPath string, outDir string) {
+	runBuild(configPath, buildOptions(outDir))
+	if useColor() && logFile == nil {
+		// the log file gets what stderr gets, and stays plain
+		log.Println("\x1b[32mAll done!\x1b[0m")
+	} else {
+		log.Println("All done!")
+	}
+}
+
+// doWatch builds, then rebuilds as local sources change, until killed
+func doWatch(configPath string, outDir string) {
+	config := loadConfig(configPath)
+	builder := newBuilder(config)
+
+	opts := ottolib.WatchOptions{
+		Build:    buildOptions(outDir),
+		Debounce: *debounceArg,
+		Built: func(res *ottolib.Result, err error) {
+			if *statsArg || err != nil {
+				res.PrintSummary(os.Stderr)
+			}
 			if err != nil {
-				log.Fatal(err)
+				log.Printf("Build failed: %s", err)
 			}
+			log.Printf("Watching for changes...")
+		},
+	}
 
-			srcDir := filepath.Join(pkgSrc, dir.Name())
+	err := builder.Watch(context.Background(), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-			func() {
-				log.Println("Entering", srcDir)
-				err = os.Chdir(srcDir)
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer os.Chdir(baseWd)
+// doBuildOne builds a single package and everything it depends on into
+// a fresh prefix, ignoring --resume, then prints where it ended up.
+func doBuildOne(configPath string, pkgName string, outDir string) {
+	if outDir == "" {
+		var err error
+		outDir, err = ioutil.TempDir("", "otto-"+pkgName+"-")
+		if err != nil {
+			log.Fatal("While creating temporary outDir", err)
+		}
+	}
 
-				configureArgs := []string{}
-				configureArgs = append(configureArgs, "--prefix="+prefix)
+	opts := buildOptions(outDir)
+	opts.Resume = ""
+	opts.ResumeProfile = ""
+	opts.Packages = []string{pkgName}
+	opts.RequireEmptyPrefix = true
 
-				configureBlacklist := &Blacklist{Prefixes: pkg.ConfigureBlacklist}
+	res := runBuild(configPath, opts)
+	for _, prefix := range res.Prefixes {
+		fmt.Println(prefix)
+	}
+}
 
-				for _, arg := range profile.Configure {
-					if !configureBlacklist.Has(arg) {
-						configureArgs = append(configureArgs, arg)
-					}
-				}
+func doScript(configPath string, outDir string) {
+	config := loadConfig(configPath)
 
-				for _, arg := range pkg.Configure {
-					if !configureBlacklist.Has(arg) {
-						configureArgs = append(configureArgs, arg)
-					}
-				}
+	err := newBuilder(config).WriteScript(os.Stdout, buildOptions(outDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-				// replace usage of $PREFIX, etc
-				for i := range configureArgs {
-					configureArgs[i] = expand(configureArgs[i])
-				}
+func doFetch(configPath string, dir string) {
+	config := loadConfig(configPath)
 
-				log.Println("Configuring...")
+	opts := ottolib.FetchOptions{
+		Dir:       dir,
+		Profiles:  *profileArg,
+		Packages:  *fetchOnlyArg,
+		Download:  downloadOptions(),
+		PlainJSON: *plainJSONArg,
 
-				err = command("./configure", env, configureArgs...)
-				if err != nil {
-					log.Fatal(err)
-				}
+		UpstreamFilenames: *upstreamNamesArg,
+	}
 
-				log.Println("Building...")
+	manifest, err := newBuilder(config).Fetch(context.Background(), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-				err = command("make", env, makeConcurrencyFlag)
-				if err != nil {
-					log.Fatal(err)
-				}
+	log.Printf("Fetched %d archives into %s", len(manifest.Packages), dir)
+}
 
-				log.Println("Installing...")
+func doCheckURLs(configPath string) {
+	config := loadConfig(configPath)
 
-				err = command("make", env, "install")
-				if err != nil {
-					log.Fatal(err)
-				}
-			}()
+	opts := ottolib.CheckOptions{
+		Profiles: *profileArg,
+		Packages: *checkURLsOnlyArg,
+		Download: downloadOptions(),
+	}
+
+	checks, err := newBuilder(config).CheckURLs(context.Background(), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for _, check := range checks {
+		size := "? bytes"
+		if check.ContentLength >= 0 {
+			size = humanize.IBytes(uint64(check.ContentLength))
+		}
+
+		status := "OK"
+		if !check.OK() {
+			status = "FAIL: " + check.Problem
+			failed++
+		}
+
+		fmt.Printf("%s: %s (HTTP %d, %s) %s\n", check.Package, check.URL, check.StatusCode, size, status)
+		if check.FinalURL != "" {
+			fmt.Printf("  redirected to %s\n", check.FinalURL)
 		}
 	}
 
-	log.Println("All done!")
+	if failed > 0 {
+		log.Fatalf("%d of %d URLs have problems", failed, len(checks))
+	}
+}
+
+// doValidate loads the config, which fails if it's invalid, and prints
+// what LintConfigure finds
+func doValidate(configPath string) {
+	config := loadConfig(configPath)
+
+	warnings := config.LintConfigure()
+	for _, warning := range warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+
+	if len(warnings) > 0 && *validateStrictFlag {
+		log.Printf("%d warnings", len(warnings))
+		os.Exit(ottolib.ExitCode(ottolib.FailureConfig))
+	}
+	log.Printf("%s is valid", configPath)
 }
 
-func tarFlagsForFormat(format string) (string, error) {
-	switch format {
-	case "tar.gz":
-		return "xf", nil
-	case "tar.xz":
-		return "xf", nil
-	default:
-		return "", fmt.Errorf("tarFlags: unknown format %s", format)
+func doList(configPath string) {
+	config := loadConfig(configPath)
+
+	if *listTagsFlag {
+		for _, tag := range config.Tags() {
+			count := 0
+			for _, pkg := range config.Packages {
+				if pkg.HasTag(tag) {
+					count++
+				}
+			}
+			fmt.Printf("%s (%d packages)\n", tag, count)
+		}
+		return
+	}
+
+	for _, pkg := range config.Packages {
+		if len(*tagArg) > 0 && !pkg.HasTag(*tagArg...) {
+			continue
+		}
+
+		if len(pkg.Tags) > 0 {
+			fmt.Printf("%s [%s]\n", pkg.Name, strings.Join(pkg.Tags, ", "))
+		} else {
+			fmt.Println(pkg.Name)
+		}
 	}
 }
 
-func command(exe string, envIn []string, args ...string) error {
-	log.Printf("> %s %s", exe, strings.Join(args, " "))
-	log.Printf("> env: %s", strings.Join(envIn, " "))
-	env := os.Environ()
-	for _, v := range envIn {
-		env = append(env, v)
+func doGraph(configPath string) {
+	config := loadConfig(configPath)
+
+	packages := config.Packages
+	if len(*profileArg) > 0 {
+		profiles, err := config.SelectProfiles(*profileArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		packages = config.PackagesForProfiles(profiles)
+	}
+
+	for _, cycle := range config.Cycles() {
+		log.Printf("Dependency cycle: %s", strings.Join(cycle, ", "))
+	}
+
+	if *graphListFlag {
+		ordered, err := config.BuildOrder(packages)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, pkg := range ordered {
+			fmt.Println(pkg.Name)
+		}
+		return
 	}
 
-	cmd := exec.Command(exe, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = env
-	return cmd.Run()
+	err := config.WriteGraph(os.Stdout, packages)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,66 @@
+package ottolib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// resolveSecret expands ${VAR} references in s from the environment,
+// failing if any of them is unset or empty
+func resolveSecret(s string) (string, error) {
+	var missing []string
+	res := os.Expand(s, func(name string) string {
+		value := os.Getenv(name)
+		if value == "" {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is empty or unset", strings.Join(missing, ", "))
+	}
+	return res, nil
+}
+
+// authHeader returns the headers to send with download requests
+// for auth, with secrets resolved from the environment
+func authHeader(auth *Auth) (http.Header, error) {
+	header := make(http.Header)
+	if auth == nil {
+		return header, nil
+	}
+
+	if auth.Username != "" || auth.Password != "" {
+		username, err := resolveSecret(auth.Username)
+		if err != nil {
+			return nil, fmt.Errorf("auth username: %w", err)
+		}
+
+		password, err := resolveSecret(auth.Password)
+		if err != nil {
+			return nil, fmt.Errorf("auth password: %w", err)
+		}
+
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+
+	if auth.Token != "" {
+		token, err := resolveSecret(auth.Token)
+		if err != nil {
+			return nil, fmt.Errorf("auth token: %w", err)
+		}
+
+		if auth.Header != "" {
+			header.Set(auth.Header, token)
+		} else {
+			header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	return header, nil
+}
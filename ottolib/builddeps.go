@@ -0,0 +1,71 @@
+package ottolib
+
+import "path/filepath"
+
+// allDeps returns the package's deps and build deps
+func (p *Package) allDeps() []string {
+	if len(p.BuildDeps) == 0 {
+		return p.Deps
+	}
+	return append(append([]string{}, p.Deps...), p.BuildDeps...)
+}
+
+// buildOnly returns the names of the packages that are only needed to
+// build others: those only reachable from packages nothing depends on
+// through BuildDeps somewhere along the way. Everything else ships.
+func (c *Config) buildOnly() map[string]bool {
+	dependedOn := make(map[string]bool)
+	for _, pkg := range c.Packages {
+		for _, dep := range pkg.allDeps() {
+			dependedOn[dep] = true
+		}
+	}
+
+	runtime := make(map[string]bool)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		if runtime[pkg.Name] {
+			return
+		}
+		runtime[pkg.Name] = true
+		for _, dep := range pkg.Deps {
+			if depPkg := c.Package(dep); depPkg != nil {
+				visit(depPkg)
+			}
+		}
+	}
+	for _, pkg := range c.Packages {
+		if !dependedOn[pkg.Name] {
+			visit(pkg)
+		}
+	}
+
+	buildOnly := make(map[string]bool)
+	for _, pkg := range c.Packages {
+		if !runtime[pkg.Name] {
+			buildOnly[pkg.Name] = true
+		}
+	}
+	return buildOnly
+}
+
+// buildDepsPrefix is where build-only packages are installed when the
+// profile has a shared prefix, so that they don't end up in it
+func (bu *build) buildDepsPrefix(profile *Profile) string {
+	return filepath.Join(bu.opts.OutDir, "build-deps", profile.Name)
+}
+
+// sharedPrefix returns where pkg is installed with a shared prefix, and
+// the prefixes it's built with on top of that one: build-only packages
+// go to their own prefix, and each prefix sees the other
+func (bu *build) sharedPrefix(profile *Profile, prefix string, pkg *Package, buildOnly map[string]bool) (string, []string) {
+	if len(buildOnly) == 0 {
+		return prefix, nil
+	}
+
+	buildPrefix := bu.buildDepsPrefix(profile)
+	if buildOnly[pkg.Name] {
+		return buildPrefix, []string{prefix}
+	}
+	return prefix, []string{buildPrefix}
+}
@@ -0,0 +1,1111 @@
+// Package ottolib contains the build logic behind the otto command,
+// for those who would rather embed it than shell out to it.
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildOptions controls what a Builder builds and where
+type BuildOptions struct {
+	// OutDir is where sources and prefixes end up, one subdirectory per profile
+	OutDir string
+	// SrcLayout and PrefixLayout, if set, are text/template templates
+	// of LayoutVars for where package sources and profile prefixes go
+	// instead, see DefaultSrcLayout and DefaultPrefixLayout. State is
+	// always kept in <outdir>/src/<profile>.
+	SrcLayout    string
+	PrefixLayout string
+	// Profiles, if set, restricts the build to the profiles they
+	// select, see Config.SelectProfiles
+	Profiles []string
+	// Resume, if set, skips all packages before the one with that name,
+	// in every profile or only in ResumeProfile if that's set too
+	Resume string
+	// ResumeProfile, if set, skips all profiles before the one with that name
+	ResumeProfile string
+	// Packages, if set, restricts the build to these packages and their deps
+	Packages []string
+	// Tags, if set, restricts the build to packages with any of these tags
+	// (in addition to Packages, if both are set)
+	Tags []string
+	// WithDeps also builds the deps of the packages selected by Tags
+	WithDeps bool
+	// SkipDeps builds just the named Packages, not their deps, for when
+	// those are known to be built already
+	SkipDeps bool
+	// RequireEmptyPrefix makes the build fail if a profile's prefix has
+	// anything in it already, like PrefixModeFail
+	RequireEmptyPrefix bool
+	// PrefixMode, if set, overrides the PrefixMode of every profile
+	PrefixMode string
+	// RelocateTo, if set, is where profiles' prefixes get deployed. Once
+	// all of a profile's packages are built, references to its prefix
+	// in .pc, .la and foo-config files, and in rpaths (with patchelf),
+	// are rewritten to point there. $PROFILE in it is replaced with the
+	// profile's name. The relocated prefix is meant to be shipped:
+	// building more packages into it afterwards won't go well.
+	RelocateTo string
+
+	// PrefixPerPackage installs each package into its own prefix,
+	// <prefix>/pkgs/<name>, and builds it with the prefixes of all
+	// earlier packages in its search paths
+	PrefixPerPackage bool
+	// MergePrefix, with PrefixPerPackage, unions all the package
+	// prefixes into <prefix>/merged once the profile is built
+	MergePrefix bool
+	// StoreDir, if set, is a store shared by builds and profiles, where
+	// each package is installed into a prefix named by a hash of its
+	// definition, the profile's and its deps' hashes. Packages already
+	// in the store aren't built again, and packages only see their deps.
+	// The profile's prefix gets everything linked into it, in order;
+	// files from packages since removed stay put. Sources are only
+	// hashed by their URL and checksum: without a checksum, or for local
+	// directories, changed sources aren't noticed.
+	StoreDir string
+
+	// SourceDateEpoch, if non-zero, is exported as SOURCE_DATE_EPOCH,
+	// whatever the profile says
+	SourceDateEpoch int64
+
+	// Schedule is the order packages are built in, see the
+	// Schedule* constants
+	Schedule string
+	// DisabledDeps is what to do with packages depending on a disabled
+	// one, see the DisabledDeps* constants
+	DisabledDeps string
+
+	// MakeJobs is the N in the -jN passed to make
+	MakeJobs int
+	// RetrySerial retries a failed make once with -j1, for packages
+	// whose makefiles aren't parallel-safe
+	RetrySerial bool
+	// MaxLoad, if non-zero, makes otto wait before building each package
+	// until the load average is at most this much. It's ignored where
+	// the load average can't be read.
+	MaxLoad float64
+	// EnforceEnvFingerprint fails the build when a profile's build
+	// environment (tool versions, CC, CFLAGS...) isn't the one recorded
+	// in its state, instead of warning about it
+	EnforceEnvFingerprint bool
+	// NoPrefixPath stops <prefix>/bin from being prepended to PATH
+	// when building packages
+	NoPrefixPath bool
+
+	// KeepGoing makes the build carry on with other packages when one
+	// fails, instead of stopping right away. Packages that depend on a
+	// failed one are skipped.
+	KeepGoing bool
+
+	// Repair only builds the packages that look broken in the prefix,
+	// out of those that would be built otherwise, along with those that
+	// depend on them: packages that were never built successfully, and
+	// those with files they installed or InstallCheck paths missing
+	Repair bool
+
+	// Deadline, if non-zero, is how long the whole build has. Past it,
+	// no more packages are built, and the build fails with
+	// FailureDeadline once state is written. Commands still running get
+	// killed DeadlineGrace after it.
+	Deadline      time.Duration
+	DeadlineGrace time.Duration
+
+	// Download controls how archives are downloaded
+	Download DownloadOptions
+	// ExtractJobs, if non-zero, is how many packages get downloaded and
+	// extracted in the background while earlier ones are being built
+	ExtractJobs int
+	// PrefixOutput prefixes every line of output of the commands otto
+	// runs with [profile/package], so that it's clear where it's from
+	PrefixOutput bool
+	// Tar is the tar binary to extract with, defaults to the first of
+	// gtar, tar and bsdtar in PATH
+	Tar string
+	// NativeExtract extracts archives in Go instead of with a tar binary
+	NativeExtract bool
+	// SourceDir, if set, is a directory of pre-downloaded archives to
+	// build from instead of downloading anything
+	SourceDir string
+	// Offline never downloads anything, and only builds from archives
+	// earlier builds left in the outdir (or from SourceDir)
+	Offline bool
+	// AssertNoNetwork fails packages whose configure, build or install
+	// steps try to access the network, going by the proxy variables
+	// they're given, see netGuard. otto's own downloads are allowed.
+	AssertNoNetwork bool
+	// UpstreamFilenames names downloaded archives after their URL
+	// instead of <name>.<format>, for packages without a Filename
+	UpstreamFilenames bool
+	// VerifyExtract records how many files each archive has in each
+	// profile's state file, and fails if that changes for the same archive
+	VerifyExtract bool
+	// StrictConfigure fails packages whose configure script warns about
+	// options it doesn't recognize, instead of just passing the warning on
+	StrictConfigure bool
+	// ReportFeatures picks the optional features configure enabled or
+	// disabled out of its output, and records them in the result
+	ReportFeatures bool
+	// StrictOverwrites fails packages that overwrite files installed by
+	// other packages, instead of warning about it
+	StrictOverwrites bool
+
+	// Sandbox runs the configure, build and install steps in a
+	// bubblewrap (bwrap) sandbox, Linux only. Only the outdir, the prefix,
+	// a few system directories and SandboxPaths are visible in it.
+	Sandbox bool
+	// SandboxPaths are extra paths made visible (read-only) in the sandbox
+	SandboxPaths []string
+
+	// PlainJSON keeps state files uncompressed no matter how big they get
+	PlainJSON bool
+}
+
+// Builder builds the packages of a config, for each of its profiles
+type Builder struct {
+	Config *Config
+	Logger Logger
+
+	// Stdout and Stderr are where the output of the commands otto
+	// runs goes, os.Stdout and os.Stderr if nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewBuilder returns a Builder for config that logs to stderr
+func NewBuilder(config *Config) *Builder {
+	return &Builder{
+		Config: config,
+		Logger: NewLogger(os.Stderr),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// build holds the state of a single Build or Fetch call
+type build struct {
+	ctx    context.Context
+	logger Logger
+	stdout io.Writer
+	stderr io.Writer
+	client *http.Client
+	config *Config
+	opts   BuildOptions
+	result *Result
+
+	// baseLogger is logger without the [main] or [worker N] in front,
+	// see worker()
+	baseLogger Logger
+
+	// downloaded maps sources to where we already downloaded them
+	downloaded     map[string]string
+	downloadedLock *sync.Mutex
+
+	// foundTar is found on first use, see tar()
+	foundTar *lazyTar
+
+	// state is the current profile's
+	state     *State
+	stateLock *sync.Mutex
+
+	// recorded is set with Download.ChecksumFile
+	recorded *recordedChecksums
+	// hostSlots is set with Download.MaxPerHost
+	hostSlots *hostSlots
+
+	// wrapper is the current profile's CommandWrapper
+	wrapper []string
+	// outputLock is held while writing lines of output, see PrefixOutput
+	outputLock *sync.Mutex
+
+	// layout is where sources and prefixes go
+	layout *layout
+
+	// deadline is when BuildOptions.Deadline runs out, if it's set
+	deadline time.Time
+
+	// limits are those of the package being built, if it has any.
+	// Packages are built one at a time, and only buildCommand uses them.
+	limits *packageLimits
+}
+
+func (b *Builder) newBuild(ctx context.Context, opts BuildOptions, result *Result) (*build, error) {
+	logger := b.Logger
+	if logger == nil {
+		logger = DiscardLogger()
+	}
+
+	client, err := newHTTPClient(b.Config.Pins, opts.Download)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := newLayout(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, stderr := b.Stdout, b.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	bu := &build{
+		ctx:        ctx,
+		logger:     logger,
+		baseLogger: logger,
+		stdout:     stdout,
+		stderr:     stderr,
+		client:     client,
+		config:     b.Config,
+		opts:       opts,
+		result:     result,
+		layout:     layout,
+
+		downloaded:     make(map[string]string),
+		downloadedLock: &sync.Mutex{},
+		foundTar:       &lazyTar{},
+		stateLock:      &sync.Mutex{},
+		outputLock:     &sync.Mutex{},
+	}
+	if opts.ExtractJobs > 0 {
+		// with workers around, say who's talking
+		bu.logger = withPrefix(logger, "[main] ")
+	}
+	client.CheckRedirect = bu.checkRedirect
+
+	if opts.Download.MaxPerHost > 0 {
+		bu.hostSlots = newHostSlots(opts.Download.MaxPerHost)
+	}
+	if opts.Download.ChecksumFile != "" {
+		bu.recorded, err = loadRecordedChecksums(opts.Download.ChecksumFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bu, nil
+}
+
+// Build runs a build with the given options. The returned Result is
+// never nil, and describes what happened even when an error is returned.
+func (b *Builder) Build(ctx context.Context, opts BuildOptions) (*Result, error) {
+	result := newResult()
+	defer result.finish()
+
+	outDir, err := filepath.Abs(opts.OutDir)
+	if err != nil {
+		return result, fmt.Errorf("while absolutizing outDir: %w", err)
+	}
+	opts.OutDir = outDir
+
+	if opts.MakeJobs <= 0 {
+		opts.MakeJobs = 1
+	}
+
+	plans, err := b.Plan(opts)
+	if err != nil {
+		return result, withCategory(FailureConfig, err)
+	}
+
+	bu, err := b.newBuild(ctx, opts, result)
+	if err != nil {
+		return result, err
+	}
+
+	if opts.Deadline > 0 {
+		bu.deadline = time.Now().Add(opts.Deadline)
+		var cancel context.CancelFunc
+		bu.ctx, cancel = context.WithDeadline(bu.ctx, bu.deadline.Add(opts.DeadlineGrace))
+		defer cancel()
+	}
+
+	for _, warning := range b.Config.LintConfigure() {
+		bu.logger.Warnf("%s", warning)
+	}
+
+	// catch sources outside --allowed-hosts before building anything
+	for _, pp := range plans {
+		for _, d := range pp.Packages {
+			if !pp.Build || !d.Build {
+				continue
+			}
+			err = checkPackageHosts(d.Package, opts.Download.AllowedHosts, "allowed hosts (see --allowed-hosts)")
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, pp := range plans {
+		if !pp.Build {
+			bu.logger.Infof("Skipping %s (%s)", pp.Profile.Name, pp.Reason)
+			continue
+		}
+
+		err = bu.buildProfile(pp.Profile, pp.Packages)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if failed := result.Count(StatusFailed); failed > 0 {
+		return result, fmt.Errorf("%d packages failed to build", failed)
+	}
+
+	return result, nil
+}
+
+func (bu *build) buildProfile(profile *Profile, decisions []*Decision) error {
+	bu.logger.Infof("Dealing with profile %s", profile.Name)
+	bu.wrapper = profile.CommandWrapper
+
+	src, prefix, err := bu.profileDirs(profile)
+	if err != nil {
+		return err
+	}
+
+	cleaned, err := bu.applyPrefixMode(profile, prefix)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(src, 0755)
+	if err != nil {
+		return fmt.Errorf("while creating source directory: %w", err)
+	}
+
+	err = os.MkdirAll(prefix, 0755)
+	if err != nil {
+		return fmt.Errorf("while creating prefix directory: %w", err)
+	}
+	bu.result.Prefixes = append(bu.result.Prefixes, prefix)
+
+	bu.state, err = readState(src)
+	if err != nil {
+		return err
+	}
+	if cleaned {
+		// none of those files are there anymore
+		bu.state.Owners = make(map[string]string)
+	}
+	defer func() {
+		if err := bu.writeState(src); err != nil {
+			bu.logger.Warnf("%s", err)
+		}
+	}()
+
+	err = bu.checkFingerprint(profile)
+	if err != nil {
+		return err
+	}
+
+	switch bu.opts.Schedule {
+	case "", ScheduleOrder:
+	case ScheduleLPT:
+		decisions = lptOrder(decisions, bu.state.Timings)
+	default:
+		return fmt.Errorf("unknown schedule %s", bu.opts.Schedule)
+	}
+
+	var store *packageStore
+	if bu.opts.StoreDir != "" {
+		store, err = newStore(bu.opts.StoreDir, bu.config, profile)
+		if err != nil {
+			return err
+		}
+	}
+
+	buildOnly := bu.config.buildOnly()
+
+	var jobs []*prepareJob
+	var inherited []string
+	// with Repair, broken packages and everything depending on them
+	repairing := make(map[string]bool)
+	for _, d := range decisions {
+		pkg := d.Package
+		res := bu.result.add(profile, pkg)
+
+		pkgPrefix, earlier := bu.sharedPrefix(profile, prefix, pkg, buildOnly)
+		if store != nil {
+			pkgPrefix = store.path(pkg)
+			earlier, err = store.depPaths(pkg)
+			if err != nil {
+				return err
+			}
+		} else if bu.opts.PrefixPerPackage {
+			// even packages we skip may have been built by an earlier run
+			pkgPrefix = packagePrefix(prefix, pkg)
+			earlier = inherited
+			inherited = append(inherited, pkgPrefix)
+		}
+
+		if !d.Build {
+			bu.logger.Infof("Skipping %s (%s)", pkg.Name, d.Reason)
+			res.Status = StatusSkipped
+			res.Reason = d.Reason
+			continue
+		}
+		if store != nil && store.completePath(pkg) != "" {
+			bu.logger.Infof("Skipping %s (already in the store, %s)", pkg.Name, pkgPrefix)
+			res.Status = StatusSkipped
+			res.Reason = "already in the store"
+			continue
+		}
+		if bu.opts.Repair {
+			reason := bu.brokenReason(pkg, prefix, pkgPrefix)
+			if dep := brokenDep(pkg, repairing); reason == "" && dep != "" {
+				reason = fmt.Sprintf("depends on %s, which is being repaired", dep)
+			}
+			if reason == "" {
+				bu.logger.Infof("Skipping %s (not broken)", pkg.Name)
+				res.Status = StatusSkipped
+				res.Reason = "not broken"
+				continue
+			}
+			bu.logger.Infof("Repairing %s (%s)", pkg.Name, reason)
+			repairing[pkg.Name] = true
+		}
+
+		jobs = append(jobs, &prepareJob{
+			pkg:       pkg,
+			res:       res,
+			prefix:    pkgPrefix,
+			inherited: earlier,
+		})
+	}
+
+	err = bu.checkOffline(profile, jobs)
+	if err != nil {
+		return err
+	}
+
+	prepare := func(wb *build, job *prepareJob) (*prepared, error) {
+		return wb.preparePackage(profile, job.pkg, job.prefix, job.inherited, job.res)
+	}
+
+	pipeline := bu.startPipeline(jobs, prepare)
+	defer pipeline.stop()
+
+	// with KeepGoing, packages that failed (or were skipped because
+	// of it) are broken, and so is everything that depends on them
+	broken := make(map[string]bool)
+
+	for i, job := range jobs {
+		if bu.pastDeadline() {
+			return bu.outOfTime(profile, job.pkg, fmt.Errorf("ran out of time before building %s", job.pkg.Name))
+		}
+
+		prep, err := pipeline.wait(i)
+
+		if dep := brokenDep(job.pkg, broken); dep != "" {
+			bu.logger.Warnf("Skipping %s, its dependency %s failed", job.pkg.Name, dep)
+			job.res.Status = StatusSkipped
+			job.res.Reason = fmt.Sprintf("dependency %s failed", dep)
+			broken[job.pkg.Name] = true
+			continue
+		}
+
+		attempt := func(prep *prepared, err error) error {
+			if err == nil {
+				err = bu.waitForLoad()
+			}
+			if err != nil {
+				return err
+			}
+			build := func() error {
+				return bu.withoutNetwork(job.pkg, prep, job.res, func(prep *prepared) error {
+					return bu.buildPackage(profile, job.pkg, prep, job.prefix, job.res)
+				})
+			}
+			if store != nil {
+				return bu.buildInStore(store, job.pkg, build)
+			}
+			return build()
+		}
+		// retries count from the first attempt's start
+		start := job.res.StartTime
+		err = attempt(prep, err)
+		for err != nil && job.res.Retries < job.pkg.Retries && bu.retryable(job.pkg, job.res, err) {
+			err = bu.prepareRetry(profile, job.pkg, job.res, err)
+			if err == nil {
+				err = attempt(bu.preparePackage(profile, job.pkg, job.prefix, job.inherited, job.res))
+			}
+		}
+		job.res.StartTime = start
+		killed := err != nil && bu.pastDeadline() && bu.ctx.Err() != nil
+		if killed {
+			err = withCategory(FailureDeadline, fmt.Errorf("killed %s after the deadline: %w", bu.opts.DeadlineGrace, err))
+		}
+		job.res.finish(err)
+		if err == nil {
+			bu.recordTiming(job.pkg, job.res)
+		}
+		if err != nil {
+			err = fmt.Errorf("while building %s (%s step): %w", job.pkg.Name, job.res.FailedPhase, err)
+			if killed {
+				return bu.outOfTime(profile, job.pkg, err)
+			}
+			if !bu.opts.KeepGoing {
+				return err
+			}
+
+			bu.logger.Errorf("%s", err)
+			broken[job.pkg.Name] = true
+		}
+	}
+
+	if bu.opts.PrefixPerPackage && bu.opts.MergePrefix {
+		// start over, so that files from packages since removed don't linger
+		merged := filepath.Join(prefix, "merged")
+		err := os.RemoveAll(merged)
+		if err == nil {
+			err = bu.mergePrefixes(merged, decisions, func(pkg *Package) string {
+				if buildOnly[pkg.Name] {
+					return ""
+				}
+				return packagePrefix(prefix, pkg)
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("while merging package prefixes: %w", err)
+		}
+	}
+
+	if store != nil {
+		err := bu.mergePrefixes(prefix, decisions, func(pkg *Package) string {
+			if buildOnly[pkg.Name] {
+				return ""
+			}
+			return store.completePath(pkg)
+		})
+		if err != nil {
+			return fmt.Errorf("while linking store paths into %s: %w", prefix, err)
+		}
+	}
+
+	if bu.opts.RelocateTo != "" {
+		if len(broken) > 0 {
+			bu.logger.Warnf("Not relocating %s, some of its packages failed", prefix)
+			return nil
+		}
+		return bu.relocate(prefix, strings.Replace(bu.opts.RelocateTo, "$PROFILE", profile.Name, -1))
+	}
+
+	return nil
+}
+
+// profileDirs returns where a profile's state is kept (and its sources
+// go, with the default layout), and its prefix
+func (bu *build) profileDirs(profile *Profile) (string, string, error) {
+	src := filepath.Join(bu.opts.OutDir, "src", profile.Name)
+	if profile.Prefix != "" {
+		prefix, err := filepath.Abs(profile.Prefix)
+		if err != nil {
+			return "", "", fmt.Errorf("while absolutizing prefix: %w", err)
+		}
+		return src, prefix, nil
+	}
+
+	prefix, err := bu.layout.expand(bu.layout.prefix, LayoutVars{
+		OutDir:  bu.opts.OutDir,
+		Profile: profile.Name,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return src, prefix, nil
+}
+
+// applyPrefixMode does what the profile's prefix mode says with a prefix
+// that has files in it already, and reports whether it emptied it
+func (bu *build) applyPrefixMode(profile *Profile, prefix string) (bool, error) {
+	mode := profile.PrefixMode
+	if bu.opts.PrefixMode != "" {
+		mode = bu.opts.PrefixMode
+	}
+	if bu.opts.RequireEmptyPrefix {
+		mode = PrefixModeFail
+	}
+	if mode == "" || mode == PrefixModeReuse {
+		return false, nil
+	}
+
+	files, err := ioutil.ReadDir(prefix)
+	if err != nil || len(files) == 0 {
+		return false, nil
+	}
+
+	switch mode {
+	case PrefixModeFail:
+		return false, fmt.Errorf("prefix %s is not empty", prefix)
+	case PrefixModeClean:
+		if bu.opts.Resume != "" && (bu.opts.ResumeProfile == "" || bu.opts.ResumeProfile == profile.Name) {
+			return false, fmt.Errorf("cleaning prefix %s would remove the packages --resume skips", prefix)
+		}
+		if filepath.Dir(prefix) == prefix {
+			return false, fmt.Errorf("refusing to clean prefix %s", prefix)
+		}
+		bu.logger.Infof("Cleaning prefix %s (%d entries)", prefix, len(files))
+		err = os.RemoveAll(prefix)
+		if err != nil {
+			return false, fmt.Errorf("while cleaning prefix: %w", err)
+		}
+		return true, nil
+	default:
+		return false, checkPrefixMode(mode)
+	}
+}
+
+// brokenDep returns the first of pkg's deps that's broken, if any
+func brokenDep(pkg *Package, broken map[string]bool) string {
+	for _, dep := range pkg.allDeps() {
+		if broken[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+// prepared is a package that's been downloaded and extracted,
+// ready to be configured and built
+type prepared struct {
+	srcDir string
+	env    []string
+	expand func(string) string
+}
+
+// preparePackage downloads and extracts a package. It may be called
+// for several packages concurrently, see startPipeline.
+func (bu *build) preparePackage(profile *Profile, pkg *Package, prefix string, inherited []string, res *PackageResult) (*prepared, error) {
+	res.StartTime = time.Now()
+
+	expand := func(s string) string {
+		res := strings.Replace(s, "$PREFIX", prefix, -1)
+		return res
+	}
+
+	bu.logger.Infof("Preparing %s", pkg.Name)
+	env := bu.buildEnv(profile, pkg, prefix, inherited, expand)
+
+	pkgSrc, err := bu.pkgSrcDir(profile.Name, pkg.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(pkgSrc, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("while creating package source directory: %w", err)
+	}
+
+	format, err := formatForPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgArchive := filepath.Join(pkgSrc, bu.archiveName(pkg, format))
+	if format == FormatDir {
+		// it's used as is, see extract
+		pkgArchive, _ = localPath(pkg.Sources)
+	}
+	res.Archive = pkgArchive
+
+	err = res.phase("download", func() error {
+		return bu.fetchPackage(pkg, pkgArchive, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pkg.VerifyCommand) > 0 {
+		err = res.phase("verify", func() error {
+			return bu.customVerify(pkg, pkgArchive, pkgSrc, env)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var srcDir string
+	err = res.phase("extract", func() error {
+		epoch, err := bu.sourceDateEpoch(profile, pkg, format, pkgArchive)
+		if err != nil {
+			return err
+		}
+		if epoch != "" {
+			env = append(env, "SOURCE_DATE_EPOCH="+epoch)
+		}
+
+		if bu.opts.VerifyExtract && len(pkg.ExtractCommand) == 0 && format != FormatDir {
+			err = bu.verifyExtracted(pkg.Name, format, pkgArchive)
+			if err != nil {
+				return err
+			}
+		}
+
+		keep := []string{filepath.Base(pkgArchive)}
+		for i := range pkg.ExtraSources {
+			extraPkg := pkg.extraPackage(i)
+			if extraFormat, err := formatForPackage(extraPkg); err == nil {
+				keep = append(keep, bu.archiveName(extraPkg, extraFormat))
+			}
+		}
+		err = bu.cleanPartialExtract(pkgSrc, keep)
+		if err != nil {
+			return err
+		}
+
+		srcDir, err = bu.extract(pkg, format, pkgArchive, pkgSrc, env)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, extra := range pkg.ExtraSources {
+		err = bu.prepareExtraSource(pkg.extraPackage(i), extra, pkgSrc, srcDir, env, res)
+		if err != nil {
+			return nil, fmt.Errorf("while preparing extra source %s: %w", extra.URL, err)
+		}
+	}
+
+	// only now is the source tree complete
+	err = markExtracted(pkgSrc)
+	if err != nil {
+		return nil, fmt.Errorf("while marking %s as extracted: %w", pkgSrc, err)
+	}
+
+	return &prepared{
+		srcDir: srcDir,
+		env:    env,
+		expand: expand,
+	}, nil
+}
+
+// prepareExtraSource downloads one of a package's extra sources next to
+// its main archive, then extracts it into the source tree
+func (bu *build) prepareExtraSource(extraPkg *Package, extra *ExtraSource, pkgSrc string, srcDir string, env []string, res *PackageResult) error {
+	format, err := formatForPackage(extraPkg)
+	if err != nil {
+		return err
+	}
+
+	archive := filepath.Join(pkgSrc, bu.archiveName(extraPkg, format))
+	if format == FormatDir {
+		archive, _ = localPath(extraPkg.Sources)
+	}
+	err = res.phase("download", func() error {
+		// res.URL is the main archive's
+		url := res.URL
+		defer func() { res.URL = url }()
+		return bu.fetchPackage(extraPkg, archive, res)
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.phase("extract", func() error {
+		if bu.opts.VerifyExtract && format != FormatDir {
+			err := bu.verifyExtracted(extraPkg.Name, format, archive)
+			if err != nil {
+				return err
+			}
+		}
+
+		return bu.extractExtra(extraPkg, format, archive, filepath.Join(srcDir, extra.Dest), env)
+	})
+}
+
+// packageCommands is how a package is configured and installed
+type packageCommands struct {
+	prefixStyle   string
+	configureArgs []string
+	// configureOrigins maps the options in configureArgs (without
+	// values) to where they came from, like "profile x's Configure"
+	configureOrigins map[string][]string
+	// configureEnv is the build env with the package's ConfigureEnv on top
+	configureEnv []string
+	installArgs  []string
+}
+
+// packageCommands works out the args configure and make install are
+// run with for a package, given its build env
+func (bu *build) packageCommands(profile *Profile, pkg *Package, prefix string, env []string, expand func(string) string) (*packageCommands, error) {
+	prefixStyle := pkg.PrefixStyle
+	if prefixStyle == "" {
+		prefixStyle = PrefixStyleConfigure
+	}
+
+	configureArgs := []string{}
+	installArgs := []string{"install"}
+
+	switch prefixStyle {
+	case PrefixStyleConfigure:
+		configureArgs = append(configureArgs, "--prefix="+prefix)
+	case PrefixStyleMakeVar:
+		installArgs = append(installArgs, "PREFIX="+prefix)
+	case PrefixStyleEnv:
+		// PREFIX is always in the build environment, nothing else to do
+	default:
+		return nil, fmt.Errorf("unknown prefix style %s", prefixStyle)
+	}
+
+	// origins says where each arg came from, for configureOrigins
+	var origins []string
+	for range configureArgs {
+		origins = append(origins, "otto")
+	}
+
+	args, argOrigins := mergeConfigure(profile, pkg, func(cond *ConditionalArg) bool {
+		if err := bu.checkTool(cond.RequiresTool, env); err != nil {
+			bu.logger.Infof("Not passing %s: %s", cond.Arg, err)
+			return false
+		}
+		bu.logger.Infof("Passing %s, %s found", cond.Arg, cond.RequiresTool)
+		return true
+	})
+	configureArgs = append(configureArgs, args...)
+	origins = append(origins, argOrigins...)
+
+	if profile.ConfigCache != "" && !pkg.NoConfigCache {
+		configureArgs = append(configureArgs, "--cache-file="+bu.configCachePath(profile, env))
+		origins = append(origins, fmt.Sprintf("profile %s's ConfigCache", profile.Name))
+	}
+
+	// replace usage of $PREFIX, etc, then templates
+	vars := ConfigureVars{
+		NumCPU:  runtime.NumCPU(),
+		Prefix:  prefix,
+		Profile: profile.Name,
+		Package: pkg.Name,
+	}
+	configureOrigins := make(map[string][]string)
+	for i := range configureArgs {
+		arg, err := expandConfigureArg(expand(configureArgs[i]), vars, env)
+		if err != nil {
+			return nil, withCategory(FailureConfig, err)
+		}
+		configureArgs[i] = arg
+		name := optionName(configureArgs[i])
+		configureOrigins[name] = append(configureOrigins[name], origins[i])
+	}
+
+	// later values win, so this overrides the build env
+	configureEnv := append([]string{}, env...)
+	for k, v := range pkg.ConfigureEnv {
+		configureEnv = append(configureEnv, fmt.Sprintf("%s=%s", k, expand(v)))
+	}
+
+	return &packageCommands{
+		prefixStyle:      prefixStyle,
+		configureArgs:    configureArgs,
+		configureOrigins: configureOrigins,
+		configureEnv:     configureEnv,
+		installArgs:      installArgs,
+	}, nil
+}
+
+// buildPackage configures, builds and installs a prepared package
+func (bu *build) buildPackage(profile *Profile, pkg *Package, prep *prepared, prefix string, res *PackageResult) error {
+	srcDir := prep.srcDir
+	env := prep.env
+	expand := prep.expand
+
+	configureDir, buildDir, err := packageDirs(pkg, srcDir)
+	if err != nil {
+		return err
+	}
+	bu.logger.Infof("Building in %s", buildDir)
+
+	limits, err := pkg.limits()
+	if err != nil {
+		return err
+	}
+	ctx := bu.ctx
+	if limits != nil {
+		if limits.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(bu.ctx, limits.timeout)
+			defer cancel()
+			limits.ctx = ctx
+		}
+		bu.limits = limits
+		defer func() { bu.limits = nil }()
+	}
+
+	if len(pkg.RequiresTools) > 0 {
+		err = res.phase("tools", func() error {
+			for _, tool := range pkg.RequiresTools {
+				err := bu.checkTool(tool, env)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(pkg.BuildSteps) > 0 {
+		err := bu.watchOverwrites(pkg, prefix, res, func() error {
+			return bu.runBuildSteps(pkg, prep, buildDir, prefix, res)
+		})
+		if err != nil {
+			return err
+		}
+		return bu.installCheck(pkg, prefix, res)
+	}
+
+	var cmds *packageCommands
+	err = res.phase("configure", func() error {
+		var err error
+		cmds, err = bu.packageCommands(profile, pkg, prefix, env, expand)
+		if err != nil {
+			return err
+		}
+
+		configure := filepath.Join(configureDir, "configure")
+		info, err := os.Stat(configure)
+		if os.IsNotExist(err) {
+			if cmds.prefixStyle != PrefixStyleConfigure {
+				// plain Makefile projects often don't have a configure script at all
+				bu.logger.Infof("No configure script, skipping configure")
+				return nil
+			}
+			return fmt.Errorf("no configure script in %s (it may need generating with autoreconf, or a different prefix style if it doesn't use autotools)", configureDir)
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&0100 == 0 {
+			// some archive tools and filesystems lose the executable bit
+			bu.logger.Warnf("configure isn't executable, fixing that")
+			err = os.Chmod(configure, info.Mode()|0111)
+			if err != nil {
+				return fmt.Errorf("while making configure executable: %w", err)
+			}
+		}
+
+		bu.logger.Infof("Configuring...")
+		scanner := &configureScanner{}
+		res.ConfigureArgs = cmds.configureArgs
+		res.ran("./configure", cmds.configureArgs...)
+		err = bu.buildCommandTee(configureDir, prefix, scanner, "./configure", cmds.configureEnv, cmds.configureArgs...)
+		if err != nil {
+			return err
+		}
+		scanner.done()
+
+		if bu.opts.ReportFeatures {
+			bu.reportFeatures(pkg, scanner.features, res)
+		}
+		err = checkFeatures(pkg, scanner.features)
+		if err != nil {
+			return err
+		}
+		return bu.checkUnrecognized(cmds, scanner.found)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = res.phase("build", func() error {
+		bu.logger.Infof("Building...")
+		res.ran("make", fmt.Sprintf("-j%d", bu.opts.MakeJobs))
+		err := bu.buildCommand(buildDir, prefix, "make", env, fmt.Sprintf("-j%d", bu.opts.MakeJobs))
+		if err == nil || !bu.opts.RetrySerial || bu.opts.MakeJobs <= 1 || ctx.Err() != nil {
+			return err
+		}
+
+		// usually a missing dependency in the package's makefiles
+		bu.logger.Warnf("Parallel build of %s failed (%s), retrying with -j1", pkg.Name, err)
+		res.SerialRetry = true
+		res.ran("make", "-j1")
+		return bu.buildCommand(buildDir, prefix, "make", env, "-j1")
+	})
+	if err != nil {
+		return err
+	}
+
+	umask, err := profile.umask()
+	if err != nil {
+		return err
+	}
+
+	err = bu.watchOverwrites(pkg, prefix, res, func() error {
+		return res.phase("install", func() error {
+			bu.logger.Infof("Installing...")
+			res.ran("make", cmds.installArgs...)
+			install := func() error {
+				return bu.buildCommand(buildDir, prefix, "make", env, cmds.installArgs...)
+			}
+			if umask < 0 {
+				return install()
+			}
+
+			// the umask is process-wide, so this also applies to anything
+			// being extracted in the background meanwhile
+			bu.logger.Infof("Installing with umask %03o", umask)
+			return withUmask(umask, install)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return bu.installCheck(pkg, prefix, res)
+}
+
+// packageDirs returns where a package is configured and built, given
+// its source tree, and makes sure they exist
+func packageDirs(pkg *Package, srcDir string) (string, string, error) {
+	configureDir := filepath.Join(srcDir, pkg.ConfigureDir)
+	buildDir := configureDir
+	if pkg.BuildDir != "" {
+		buildDir = filepath.Join(srcDir, pkg.BuildDir)
+	}
+
+	for _, dir := range []string{configureDir, buildDir} {
+		stats, err := os.Stat(dir)
+		if err != nil || !stats.IsDir() {
+			return "", "", fmt.Errorf("%s isn't a directory in the source tree of %s (see ConfigureDir and BuildDir)", dir, pkg.Name)
+		}
+	}
+	return configureDir, buildDir, nil
+}
+
+// installCheck makes sure everything in the package's InstallCheck
+// made it into the prefix
+func (bu *build) installCheck(pkg *Package, prefix string, res *PackageResult) error {
+	if len(pkg.InstallCheck) == 0 {
+		return nil
+	}
+
+	return res.phase("install check", func() error {
+		var missing []string
+		for _, p := range pkg.InstallCheck {
+			if _, err := os.Stat(filepath.Join(prefix, p)); err != nil {
+				missing = append(missing, p)
+			}
+		}
+
+		if len(missing) > 0 {
+			return fmt.Errorf("%s not found in %s after install", strings.Join(missing, ", "), prefix)
+		}
+		bu.logger.Infof("Install check OK (%d paths)", len(pkg.InstallCheck))
+		return nil
+	})
+}
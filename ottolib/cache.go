@@ -0,0 +1,64 @@
+package ottolib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// cacheKey is what a package's archive is called in the cache dir, so
+// that the same URL with a different checksum is a different entry
+func cacheKey(pkg *Package) string {
+	sum := sha256.Sum256([]byte(pkg.Sources + "#" + pkg.Checksum))
+	return hex.EncodeToString(sum[:])
+}
+
+// fetchCached is what fetchPackage does with a CacheDir: the archive is
+// downloaded into the cache unless it's there already, then linked (or
+// copied) to dest. Entries are locked while they're being looked at, so
+// that several otto processes can share the cache dir.
+//
+// Entries with a checksum are used as long as they match it. Those
+// without one are revalidated with the server, see httpValidators.
+func (bu *build) fetchCached(pkg *Package, dest string, res *PackageResult) error {
+	dir := bu.opts.Download.CacheDir
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("while creating cache dir: %w", err)
+	}
+
+	key := cacheKey(pkg)
+	entry := filepath.Join(dir, key)
+
+	lock, err := lockFile(entry + ".lock")
+	if err != nil {
+		return fmt.Errorf("while locking cache entry for %s: %w", pkg.Name, err)
+	}
+	defer lock.Close()
+
+	_, statErr := os.Stat(entry)
+	switch {
+	case statErr == nil && ((pkg.Checksum != "" && !bu.opts.Download.ForceDownload) || bu.opts.Offline):
+		err = bu.verifyChecksum(entry, pkg.Checksum)
+		if err == nil {
+			bu.logger.Infof("Using cached %s", entry)
+			res.CacheHit = true
+			return linkOrCopy(entry, dest)
+		}
+		if bu.opts.Offline {
+			return fmt.Errorf("offline, and the cached archive for %s at %s is bad: %w", pkg.Name, entry, err)
+		}
+		bu.logger.Warnf("Cached archive for %s is bad (%s), downloading it again", pkg.Name, err)
+	case bu.opts.Offline:
+		bu.logger.Infof("%s isn't in the cache", pkg.Name)
+		return bu.useCached(pkg, dest)
+	}
+
+	err = bu.downloadPackage(pkg, entry, res)
+	if err != nil {
+		return err
+	}
+	return linkOrCopy(entry, dest)
+}
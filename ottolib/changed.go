@@ -0,0 +1,109 @@
+package ottolib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// LoadConfigAt reads and parses the config file at configPath, and the
+// files it includes, as they were in the git revision ref (a commit,
+// branch, tag...) of the repository it's in
+func LoadConfigAt(configPath string, ref string) (*Config, error) {
+	read := func(p string) ([]byte, error) {
+		dir, base := filepath.Split(p)
+		if dir == "" {
+			dir = "."
+		}
+
+		var stderr bytes.Buffer
+		// "./" makes the path relative to dir rather than to the repo root
+		cmd := exec.Command("git", "show", fmt.Sprintf("%s:./%s", ref, base))
+		cmd.Dir = dir
+		cmd.Stderr = &stderr
+		configBytes, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("while reading config at %s: %w (%s)", ref, err, strings.TrimSpace(stderr.String()))
+		}
+		return configBytes, nil
+	}
+
+	return loadConfig(configPath, fmt.Sprintf("%s at %s", configPath, ref), read)
+}
+
+// ChangedSince returns the names of the packages whose definition is
+// different in c than in old (including those that are new in c), along
+// with every package that depends on them, directly or not. Packages are
+// in config order. Changes to profiles aren't taken into account.
+func (c *Config) ChangedSince(old *Config) ([]string, error) {
+	changed := make(map[string]bool)
+	for _, pkg := range c.Packages {
+		previous := old.Package(pkg.Name)
+		if previous == nil {
+			changed[pkg.Name] = true
+			continue
+		}
+
+		same, err := samePackage(pkg, previous)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			changed[pkg.Name] = true
+		}
+	}
+
+	// dependents need rebuilding against the changed packages
+	return c.withDependents(changed), nil
+}
+
+// withDependents returns the names in set, along with every package
+// that depends on one of them, directly or not, in config order
+func (c *Config) withDependents(set map[string]bool) []string {
+	all := make(map[string]bool)
+	for name := range set {
+		all[name] = true
+	}
+
+	// keep going until there are no new ones
+	for grew := true; grew; {
+		grew = false
+		for _, pkg := range c.Packages {
+			if all[pkg.Name] {
+				continue
+			}
+			for _, dep := range pkg.allDeps() {
+				if all[dep] {
+					all[pkg.Name] = true
+					grew = true
+					break
+				}
+			}
+		}
+	}
+
+	var names []string
+	for _, pkg := range c.Packages {
+		if all[pkg.Name] {
+			names = append(names, pkg.Name)
+		}
+	}
+	return names
+}
+
+// samePackage compares two package definitions field by field, by
+// comparing their JSON encoding
+func samePackage(a *Package, b *Package) (bool, error) {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aJSON, bJSON), nil
+}
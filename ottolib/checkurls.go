@@ -0,0 +1,145 @@
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CheckOptions controls what Builder.CheckURLs checks
+type CheckOptions struct {
+	// Profiles, if set, select the profiles whose packages are
+	// considered, see Config.SelectProfiles
+	Profiles []string
+	// Packages, if set, restricts the check to these packages and their deps
+	Packages []string
+	// Download's timeouts and redirect settings apply to the checks too
+	Download DownloadOptions
+}
+
+// URLCheck is the outcome of checking one of a package's URLs
+type URLCheck struct {
+	Package string
+	URL     string
+	// FinalURL is where redirects led, if anywhere
+	FinalURL   string
+	StatusCode int
+	// ContentLength is -1 if the server didn't say
+	ContentLength int64
+	// Problem describes what's wrong with the URL, if anything
+	Problem string
+}
+
+// OK reports whether the URL looks like it'll download fine
+func (uc *URLCheck) OK() bool {
+	return uc.Problem == ""
+}
+
+// CheckURLs sends a HEAD request to every source and mirror of the
+// selected packages (and their extra sources), with their auth, without
+// downloading anything. Errors are only returned for problems with the
+// config, unreachable URLs are reported in the checks.
+func (b *Builder) CheckURLs(ctx context.Context, opts CheckOptions) ([]*URLCheck, error) {
+	packages := b.Config.Packages
+	if len(opts.Profiles) > 0 {
+		profiles, err := b.Config.SelectProfiles(opts.Profiles)
+		if err != nil {
+			return nil, err
+		}
+		packages = b.Config.PackagesForProfiles(profiles)
+	}
+	if len(opts.Packages) > 0 {
+		var err error
+		packages, err = resolveDeps(b.Config, opts.Packages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bu, err := b.newBuild(ctx, BuildOptions{Download: opts.Download}, newResult())
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []*URLCheck
+	for _, pkg := range packages {
+		all := []*Package{pkg}
+		for i := range pkg.ExtraSources {
+			all = append(all, pkg.extraPackage(i))
+		}
+
+		for _, p := range all {
+			if len(p.ResolverCommand) > 0 {
+				// only their resolver knows how to get to those
+				continue
+			}
+			header, err := authHeader(p.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("while setting up auth for %s: %w", p.Name, err)
+			}
+
+			for _, url := range append([]string{p.Sources}, p.Mirrors...) {
+				checks = append(checks, bu.checkURL(p, url, header))
+			}
+		}
+	}
+
+	return checks, nil
+}
+
+func (bu *build) checkURL(pkg *Package, url string, header http.Header) *URLCheck {
+	check := &URLCheck{
+		Package:       pkg.Name,
+		URL:           url,
+		ContentLength: -1,
+	}
+
+	err := bu.checkHost(url)
+	if err != nil {
+		check.Problem = err.Error()
+		return check
+	}
+
+	req, err := http.NewRequestWithContext(bu.ctx, "HEAD", url, nil)
+	if err != nil {
+		check.Problem = err.Error()
+		return check
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := bu.client.Do(req)
+	if err != nil {
+		check.Problem = err.Error()
+		return check
+	}
+	resp.Body.Close()
+
+	check.StatusCode = resp.StatusCode
+	check.ContentLength = resp.ContentLength
+	if final := resp.Request.URL.String(); final != url {
+		check.FinalURL = final
+	}
+
+	if resp.StatusCode != 200 {
+		check.Problem = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		return check
+	}
+
+	if check.FinalURL != "" {
+		// e.g. a redirect from a .tar.xz to a .tar.gz, or to an HTML page
+		expected, err := formatForPackage(pkg)
+		redirected, rerr := formatForPackage(&Package{Sources: check.FinalURL})
+		if err == nil && rerr == nil && expected != redirected {
+			check.Problem = fmt.Sprintf("redirects to a %s archive, expected %s", redirected, expected)
+		}
+	}
+
+	if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "text/html") {
+		check.Problem = "served as an HTML page"
+	}
+
+	return check
+}
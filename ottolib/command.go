@@ -0,0 +1,81 @@
+package ottolib
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// command runs exe in dir with the given args, adding envIn
+// to the inherited environment. Output goes straight to ours.
+// The profile's CommandWrapper, if any, goes in front.
+func (bu *build) command(dir string, exe string, envIn []string, args ...string) error {
+	return bu.commandTee(dir, nil, exe, envIn, args...)
+}
+
+// commandTee is like command, but also copies the command's output
+// (stdout and stderr both) to tee, if it's not nil
+func (bu *build) commandTee(dir string, tee io.Writer, exe string, envIn []string, args ...string) error {
+	return bu.runCommand(nil, dir, tee, exe, envIn, args...)
+}
+
+// runCommand is commandTee, within limits if they're not nil
+func (bu *build) runCommand(limits *packageLimits, dir string, tee io.Writer, exe string, envIn []string, args ...string) error {
+	if len(bu.wrapper) > 0 {
+		args = append(append(append([]string{}, bu.wrapper[1:]...), exe), args...)
+		exe = bu.wrapper[0]
+	}
+
+	bu.logger.Infof("> %s %s", exe, strings.Join(args, " "))
+	bu.logger.Debugf("> env: %s", strings.Join(envIn, " "))
+	env := mergeEnv(os.Environ(), envIn)
+
+	if limits == nil {
+		cmd := exec.CommandContext(bu.ctx, exe, args...)
+		flush := bu.setupCommand(cmd, dir, tee, env)
+		defer flush()
+		return cmd.Run()
+	}
+
+	ctx := bu.ctx
+	if limits.ctx != nil {
+		ctx = limits.ctx
+	}
+	cmd, err := limits.command(ctx, exe, args)
+	if err != nil {
+		return err
+	}
+	flush := bu.setupCommand(cmd, dir, tee, env)
+	defer flush()
+	return limits.explain(cmd.Run())
+}
+
+// setupCommand points cmd's output to ours (and tee), and sets its
+// dir and environment. With PrefixOutput, lines going to ours are
+// prefixed with the package they're from: the returned func writes out
+// any unfinished last line, and must be called once cmd is done.
+func (bu *build) setupCommand(cmd *exec.Cmd, dir string, tee io.Writer, env []string) func() {
+	stdout, stderr := bu.stdout, bu.stderr
+	flush := func() {}
+	if bu.opts.PrefixOutput {
+		prefix := []byte(bu.outputLabel(dir))
+		lineOut := &lineWriter{w: bu.stdout, lock: bu.outputLock, prefix: prefix}
+		lineErr := &lineWriter{w: bu.stderr, lock: bu.outputLock, prefix: prefix}
+		stdout, stderr = lineOut, lineErr
+		flush = func() {
+			lineOut.flush()
+			lineErr.flush()
+		}
+	}
+
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if tee != nil {
+		cmd.Stdout = io.MultiWriter(stdout, tee)
+		cmd.Stderr = io.MultiWriter(stderr, tee)
+	}
+	cmd.Env = env
+	return flush
+}
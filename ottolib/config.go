@@ -0,0 +1,688 @@
+package ottolib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	Profiles []*Profile
+	Packages []*Package
+
+	// Pins restricts which certificates are accepted when
+	// downloading from some hosts over HTTPS
+	Pins []*Pin
+
+	// AllowedHosts, if set, are the only hosts (or host patterns, as in
+	// pins) packages can be downloaded from, redirects included
+	AllowedHosts []string
+
+	// Defaults holds package fields, as they'd be written in a package,
+	// that every package not setting them itself gets. A package setting
+	// one, even to an empty value, keeps its own.
+	Defaults map[string]json.RawMessage `json:",omitempty"`
+
+	// Decompressors maps archive formats tar can't be relied on to read,
+	// like "tar.zst", to a command that decompresses them from stdin to
+	// stdout, like "zstd -dc". Archives are piped through it into tar
+	// (or otto's own extraction, see NativeExtract).
+	Decompressors map[string]string `json:",omitempty"`
+
+	// Include lists other config files, relative to this one, whose
+	// profiles and packages come before this file's own, in the order
+	// they're listed. Included files can include others in turn (each
+	// file is only merged in once), and can't have Pins, AllowedHosts
+	// or Decompressors. Their Defaults only apply to their own packages.
+	Include []string `json:",omitempty"`
+}
+
+// Auth holds the credentials needed to download a package's archive.
+// Any of its values can reference environment variables as ${VAR}, so
+// that secrets don't have to live in the config file.
+type Auth struct {
+	// Username and Password are sent using HTTP basic auth
+	Username string
+	Password string
+	// Token is sent as a bearer token
+	Token string
+	// Header, if set, is the header Token is sent in as-is,
+	// instead of "Authorization: Bearer <token>"
+	Header string
+}
+
+// Pin ties a host (or host pattern) to a CA bundle and/or certificate.
+// Hosts that don't match any pin use the system trust store.
+type Pin struct {
+	// Host is matched against the download host with path.Match,
+	// so "*.example.org" works
+	Host string
+	// CABundle is a PEM file with the only CAs to trust for the host
+	CABundle string
+	// CertSHA256 is the hex SHA-256 fingerprint the host's
+	// leaf certificate must have
+	CertSHA256 string
+}
+
+type Profile struct {
+	Name string
+	Env  map[string]string
+	// UnsetEnv are variables removed from the environment the profile's
+	// packages inherit from ours, before Env is applied
+	UnsetEnv []string
+	// Configure args, like those of packages, can be Go templates using
+	// ConfigureVars, like --with-build-id={{env "BUILD_ID"}}
+	Configure []string
+	Pkgconfig []string
+
+	// Prefix, if set, is where the profile's packages are installed instead
+	// of outdir/<profile>. Sources are still kept in the outdir.
+	Prefix string
+	// PrefixMode is what to do with a prefix that has files in it
+	// already, see the PrefixMode* constants. BuildOptions.PrefixMode
+	// overrides it.
+	PrefixMode string
+
+	// ConfigCache, if set, is an autoconf cache file shared by all the
+	// profile's packages. Relative paths are relative to outdir/src/<profile>.
+	// The actual file name includes a hash of the compiler and flags, so
+	// that changing them doesn't reuse stale results.
+	ConfigCache string
+
+	// Compiler is a compiler cache (ccache or sccache) to prefix CC and CXX
+	// with, if it can be found in PATH
+	Compiler string
+	// CompilerCacheDir is where the compiler cache keeps its files,
+	// defaults to outdir/cache/<compiler>
+	CompilerCacheDir string
+
+	// SourceDateEpoch, if set, is exported as SOURCE_DATE_EPOCH for
+	// reproducible builds: either a Unix timestamp, or "archive" for the
+	// time of the newest file in each package's archive
+	SourceDateEpoch string
+
+	// Umask, if set, is the octal umask (e.g. "002") packages are
+	// installed with, instead of whatever otto was started with
+	Umask string
+
+	// CommandWrapper, if set, is prepended to every command otto runs
+	// for the profile's packages, e.g. ["nice", "-n", "19"] or
+	// ["/usr/bin/time", "-v"]. With --sandbox, it runs outside of it.
+	CommandWrapper []string
+}
+
+// umask parses the profile's Umask, and returns -1 if it has none
+func (p *Profile) umask() (int, error) {
+	if p.Umask == "" {
+		return -1, nil
+	}
+
+	mask, err := strconv.ParseUint(p.Umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return -1, fmt.Errorf("profile %s: invalid umask %s, expected an octal number like 022", p.Name, p.Umask)
+	}
+	return int(mask), nil
+}
+
+type Package struct {
+	Name string
+	Env  map[string]string
+	// UnsetEnv are variables removed from the environment the package is
+	// built with, whether they're inherited from ours or set by the
+	// profile's Env. The package's own Env and otto's variables (PREFIX,
+	// PKG_CONFIG_PATH...) are still set, without their old values.
+	UnsetEnv           []string
+	Sources            string
+	Mirrors            []string
+	Checksum           string
+	Auth               *Auth
+	Format             string
+	Configure          []string
+	ConfigureBlacklist []string
+
+	// Version is only used in SBOMs, and guessed from the archive's
+	// name (e.g. foo-1.2.3.tar.gz) if not set
+	Version string
+
+	// VerifyCommand, if set, is run after the archive is downloaded and
+	// its checksum verified, before extracting it, for verification
+	// schemes otto doesn't know about. $ARCHIVE in it is replaced with
+	// the archive's path, and any command failing fails the package.
+	VerifyCommand [][]string
+
+	// ResolverCommand, if set, is run to get the package's archive instead
+	// of downloading it, for sources otto can't download itself (a
+	// bespoke URL scheme, an artifact store with its own auth flow...).
+	// $SOURCES in it is replaced with Sources (or one of the Mirrors, on
+	// retries) and $DEST with where the archive has to be written. It
+	// exiting with 0 means it was, and the checksum is then verified as
+	// for downloads. The package's extra sources are fetched with it too.
+	ResolverCommand []string
+
+	// ConfigureEnv is merged over the build environment for
+	// configure only, and not for make and make install
+	ConfigureEnv map[string]string
+
+	// ConditionalConfigure args are only passed to configure if the
+	// tool they require is found in the build's PATH
+	ConditionalConfigure []*ConditionalArg
+	// ExpectFeatures lists optional features configure has to report as
+	// enabled (true) or disabled (false), named like it prints them (see
+	// Feature), so that one silently turned off fails the build
+	ExpectFeatures map[string]bool
+
+	// RequiresTools are tools that must be in the build's PATH before
+	// the package is built, optionally with a version constraint that's
+	// checked against their --version, like "cmake>=3.20"
+	RequiresTools []string
+
+	// Filename, if set, is what the downloaded archive is called
+	// instead of <name>.<format>
+	Filename string
+
+	// ConfigurePrepend is passed to configure before the profile's args,
+	// ConfigureAppend after everything else. Neither is blacklisted.
+	ConfigurePrepend []string
+	ConfigureAppend  []string
+
+	// InstallCheck lists paths, relative to the prefix, that must exist
+	// once the package is installed, e.g. "bin/foo" or "lib/libfoo.so",
+	// to catch install targets that quietly do nothing
+	InstallCheck []string
+
+	// BuildSteps, if set, replace configure, make and make install
+	// entirely, for packages that build some other way
+	BuildSteps []*BuildStep
+	// Shell runs the build steps that use Shell, defaults to /bin/sh
+	Shell string
+
+	// PrefixStyle controls how the install prefix is communicated to the
+	// package's build system, see the PrefixStyle* constants
+	PrefixStyle string
+
+	// NoConfigCache opts out of the profile's shared autoconf cache,
+	// for packages whose configure scripts don't play well with it
+	NoConfigCache bool
+
+	// NoCompilerCache opts out of the profile's compiler cache
+	NoCompilerCache bool
+
+	// Timeout, if set, is how long the package can take to build
+	// (e.g. "30m"), from configure to install, before it's killed
+	Timeout string
+	// Retries is how many more times the package is built, from
+	// extraction on, when it fails. RetryOn, if set, restricts that to
+	// failures in some categories ("network", "timeout") or steps
+	// ("extract", "configure", "build", "install", where BuildSteps
+	// count as build). Config failures are never retried.
+	Retries int
+	RetryOn []string
+
+	// MaxMemory (e.g. "4GB") and MaxProcesses, if set, are resource
+	// limits for the package's build commands, Linux only
+	MaxMemory    string
+	MaxProcesses int
+
+	// Tags group packages, so that they can be built selectively
+	Tags []string
+	// Enabled is true unless set to false, which skips the package, and
+	// packages depending on it, see BuildOptions.DisabledDeps
+	Enabled *bool
+
+	// Deps lists the names of packages that must be built before this one
+	Deps []string
+	// BuildDeps are like Deps, but only needed to build this package
+	// (code generators and the like). Packages only ever needed to build
+	// others don't go in the profile's prefix, merged prefixes or SBOMs.
+	BuildDeps []string
+
+	// ExtractInclude, if set, lists the only archive members to extract,
+	// as tar wildcards (e.g. "*/src/*")
+	ExtractInclude []string
+	// ExtractExclude lists archive members not to extract, as tar
+	// wildcards (e.g. "*/testdata/*")
+	ExtractExclude []string
+
+	// ExtractCommand, if set, replaces the built-in extraction with these
+	// commands, run in turn in the package source dir. $ARCHIVE and $DEST
+	// in them are replaced with the archive's path and that dir.
+	ExtractCommand [][]string
+
+	// Flat is set for archives that have no top-level directory,
+	// in which case we build straight from the package source dir
+	Flat bool
+
+	// SourceDir is the directory to build from, relative to the package
+	// source dir, for archives with more than one top-level directory
+	SourceDir string
+
+	// NormalizeDir renames the archive's top-level directory to the
+	// package's name once it's extracted, so that the source tree is in
+	// the same place whatever the archive calls it (foo-1.2, foo-v1.2,
+	// foo-1.2-src...). CanonicalDir renames it to that instead, and
+	// implies NormalizeDir.
+	NormalizeDir bool
+	CanonicalDir string
+
+	// ConfigureDir is where configure is run, relative to the source
+	// tree (the top-level dir, or SourceDir), for projects that live in
+	// a subdirectory of a bigger archive. BuildDir is where make, make
+	// install and the BuildSteps run, ConfigureDir if not set.
+	ConfigureDir string
+	BuildDir     string
+
+	// ExtraSources are additional archives extracted into the source
+	// tree before configure, e.g. test suites or vendored libraries
+	ExtraSources []*ExtraSource
+}
+
+// BuildStep is a command run to build a package, either as argv
+// (with $PREFIX replaced) or, for pipes, globs and the like, as a shell
+// script run with "<shell> -c". Either way it runs in the source dir,
+// with the build environment.
+type BuildStep struct {
+	// Name is what the step is called in logs and reports,
+	// defaults to "step N"
+	Name  string
+	Args  []string
+	Shell string
+}
+
+// ConditionalArg is a configure arg that's only passed if RequiresTool
+// can be found, e.g. "--enable-docs" if "doxygen" is installed. It can
+// have a version constraint as in RequiresTools.
+type ConditionalArg struct {
+	Arg          string
+	RequiresTool string
+}
+
+// ExtraSource is an auxiliary archive that's part of a package's sources
+type ExtraSource struct {
+	URL string
+	// Dest is where the archive is extracted, relative to the
+	// package's source tree. Its top-level directory is stripped,
+	// unless Flat is set.
+	Dest     string
+	Checksum string
+	// Format is guessed from URL if not set, as with packages
+	Format string
+	Flat   bool
+}
+
+// extraPackage returns a package that stands for pkg's i-th extra
+// source, so that it can be downloaded like any other
+func (pkg *Package) extraPackage(i int) *Package {
+	extra := pkg.ExtraSources[i]
+	return &Package{
+		Name:     fmt.Sprintf("%s-extra%d", pkg.Name, i+1),
+		Sources:  extra.URL,
+		Checksum: extra.Checksum,
+		Auth:     pkg.Auth,
+		Format:   extra.Format,
+		Flat:     extra.Flat,
+
+		ResolverCommand: pkg.ResolverCommand,
+	}
+}
+
+// canonicalDir is what a package's top-level directory gets renamed to
+// after extraction, see NormalizeDir, or ""
+func (pkg *Package) canonicalDir() string {
+	if pkg.CanonicalDir != "" {
+		return pkg.CanonicalDir
+	}
+	if pkg.NormalizeDir {
+		return pkg.Name
+	}
+	return ""
+}
+
+const (
+	// PrefixStyleConfigure passes --prefix to ./configure (the default)
+	PrefixStyleConfigure = "configure"
+	// PrefixStyleMakeVar passes PREFIX=<prefix> to make install
+	PrefixStyleMakeVar = "make-var"
+	// PrefixStyleEnv only relies on PREFIX being set in the environment
+	PrefixStyleEnv = "env"
+)
+
+const (
+	// PrefixModeReuse installs over whatever is in the prefix (the default)
+	PrefixModeReuse = "reuse"
+	// PrefixModeClean empties the prefix before building the profile
+	PrefixModeClean = "clean"
+	// PrefixModeFail fails the build if the prefix isn't empty
+	PrefixModeFail = "fail"
+)
+
+func checkPrefixMode(mode string) error {
+	switch mode {
+	case "", PrefixModeReuse, PrefixModeClean, PrefixModeFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown prefix mode %s", mode)
+	}
+}
+
+type Blacklist struct {
+	Prefixes []string
+}
+
+func (bl *Blacklist) Has(s string) bool {
+	for _, p := range bl.Prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadConfig reads and parses the JSON config file at configPath, along
+// with the files it includes
+func LoadConfig(configPath string) (*Config, error) {
+	read := func(p string) ([]byte, error) {
+		configBytes, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("while reading config: %w", err)
+		}
+		return configBytes, nil
+	}
+	return loadConfig(configPath, configPath, read)
+}
+
+// loadConfig reads the config at configPath and its includes with read,
+// and validates the result. name is what the config is called in errors.
+func loadConfig(configPath string, name string, read func(string) ([]byte, error)) (*Config, error) {
+	config, err := newConfigLoader(read).load(configPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", name, err)
+	}
+
+	return config, nil
+}
+
+// parseConfig parses a single config file, without validating it or
+// looking at its includes. configPath is only used in errors.
+func parseConfig(configBytes []byte, configPath string) (*Config, error) {
+	configBytes, err := applyDefaults(configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", configPath, err)
+	}
+
+	var config Config
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing config: %w", err)
+	}
+
+	return &config, nil
+}
+
+// validate checks the things that would otherwise make builds step on
+// each other's toes. Package names in particular have to be unique, since
+// they're used for source directories - two packages can share Sources
+// as long as they have different names.
+func (c *Config) validate() error {
+	if err := c.checkDecompressors(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, pkg := range c.Packages {
+		if pkg.Name == "" {
+			return fmt.Errorf("package with sources %s has no name", pkg.Sources)
+		}
+		if seen[pkg.Name] {
+			return fmt.Errorf("duplicate package name %s", pkg.Name)
+		}
+		seen[pkg.Name] = true
+
+		if pkg.Filename != "" && filepath.Base(pkg.Filename) != pkg.Filename {
+			return fmt.Errorf("package %s: filename %s can't have slashes in it", pkg.Name, pkg.Filename)
+		}
+		if clean := filepath.Clean(pkg.Filename); pkg.Filename != "" && (clean == "." || clean == "..") {
+			return fmt.Errorf("package %s: filename %s isn't a file name", pkg.Name, pkg.Filename)
+		}
+
+		if dir := filepath.Clean(pkg.SourceDir); pkg.SourceDir != "" && (filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../")) {
+			return fmt.Errorf("package %s: source dir %s must be inside the package source dir", pkg.Name, pkg.SourceDir)
+		}
+		if canonical := pkg.canonicalDir(); canonical != "" {
+			if filepath.Base(canonical) != canonical || canonical == "." || canonical == ".." {
+				return fmt.Errorf("package %s: canonical dir %s must be a plain directory name", pkg.Name, canonical)
+			}
+			if pkg.Flat || pkg.SourceDir != "" {
+				return fmt.Errorf("package %s: there's no top-level directory to normalize with flat or sourcedir set", pkg.Name)
+			}
+		}
+		if len(pkg.ResolverCommand) > 0 && pkg.ResolverCommand[0] == "" {
+			return fmt.Errorf("package %s: resolver command has no program to run", pkg.Name)
+		}
+		for _, dir := range []string{pkg.ConfigureDir, pkg.BuildDir} {
+			if clean := filepath.Clean(dir); dir != "" && (filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../")) {
+				return fmt.Errorf("package %s: %s must be inside the source tree", pkg.Name, dir)
+			}
+		}
+
+		err := checkPackageHosts(pkg, c.AllowedHosts, "config's allowed hosts")
+		if err != nil {
+			return err
+		}
+
+		if _, err := pkg.limits(); err != nil {
+			return err
+		}
+
+		if err := checkUnsetEnv(pkg.UnsetEnv); err != nil {
+			return fmt.Errorf("package %s: %w", pkg.Name, err)
+		}
+
+		if err := checkRetryOn(pkg); err != nil {
+			return err
+		}
+
+		for _, tool := range pkg.RequiresTools {
+			if _, err := parseToolSpec(tool); err != nil {
+				return fmt.Errorf("package %s: %w", pkg.Name, err)
+			}
+		}
+		for _, cond := range pkg.ConditionalConfigure {
+			if _, err := parseToolSpec(cond.RequiresTool); err != nil {
+				return fmt.Errorf("package %s: %w", pkg.Name, err)
+			}
+			if err := checkConfigureArgs([]string{cond.Arg}); err != nil {
+				return fmt.Errorf("package %s: %w", pkg.Name, err)
+			}
+		}
+		for _, args := range [][]string{pkg.Configure, pkg.ConfigurePrepend, pkg.ConfigureAppend} {
+			if err := checkConfigureArgs(args); err != nil {
+				return fmt.Errorf("package %s: %w", pkg.Name, err)
+			}
+		}
+
+		for _, p := range pkg.InstallCheck {
+			if filepath.IsAbs(p) {
+				return fmt.Errorf("package %s: install check %s must be relative to the prefix", pkg.Name, p)
+			}
+		}
+
+		for i, step := range pkg.BuildSteps {
+			if (len(step.Args) > 0) == (step.Shell != "") {
+				return fmt.Errorf("package %s: build step %d needs either Args or Shell", pkg.Name, i+1)
+			}
+		}
+
+		for _, extra := range pkg.ExtraSources {
+			dest := filepath.Clean(extra.Dest)
+			if extra.URL == "" || filepath.IsAbs(dest) || dest == ".." || strings.HasPrefix(dest, "../") {
+				return fmt.Errorf("package %s: extra sources need a URL and a Dest inside the source tree", pkg.Name)
+			}
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, profile := range c.Profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("profile with no name")
+		}
+		if seen[profile.Name] {
+			return fmt.Errorf("duplicate profile name %s", profile.Name)
+		}
+		seen[profile.Name] = true
+
+		if _, err := profile.umask(); err != nil {
+			return err
+		}
+
+		if err := checkUnsetEnv(profile.UnsetEnv); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+
+		if err := checkPrefixMode(profile.PrefixMode); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+
+		if err := checkConfigureArgs(profile.Configure); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+
+		if e := profile.SourceDateEpoch; e != "" && e != SourceDateEpochArchive {
+			if _, err := strconv.ParseInt(e, 10, 64); err != nil {
+				return fmt.Errorf("profile %s: invalid source date epoch %s, expected a Unix timestamp or %q", profile.Name, e, SourceDateEpochArchive)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Package returns the package with the given name, or nil
+func (c *Config) Package(name string) *Package {
+	for _, pkg := range c.Packages {
+		if pkg.Name == name {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// PackagesFor returns the packages that get built for profile
+func (c *Config) PackagesFor(profile *Profile) []*Package {
+	return c.Packages
+}
+
+// SelectProfiles returns the profiles matching any of selectors, in
+// config order. Selectors are profile names or path.Match patterns
+// (like "release*"), and can be comma-separated lists of them. Each one
+// has to match at least one profile. No selectors select every profile.
+func (c *Config) SelectProfiles(selectors []string) ([]*Profile, error) {
+	var patterns []string
+	for _, sel := range selectors {
+		for _, pattern := range strings.Split(sel, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		return c.Profiles, nil
+	}
+
+	selected := make(map[string]bool)
+	for _, pattern := range patterns {
+		matched := false
+		for _, profile := range c.Profiles {
+			ok, err := path.Match(pattern, profile.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid profile pattern %s: %w", pattern, err)
+			}
+			if ok {
+				selected[profile.Name] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("unknown profile %s", pattern)
+		}
+	}
+
+	var profiles []*Profile
+	for _, profile := range c.Profiles {
+		if selected[profile.Name] {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles, nil
+}
+
+// PackagesForProfiles returns the packages built for any of profiles,
+// in config order
+func (c *Config) PackagesForProfiles(profiles []*Profile) []*Package {
+	seen := make(map[string]bool)
+	for _, profile := range profiles {
+		for _, pkg := range c.PackagesFor(profile) {
+			seen[pkg.Name] = true
+		}
+	}
+
+	var packages []*Package
+	for _, pkg := range c.Packages {
+		if seen[pkg.Name] {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages
+}
+
+// IsEnabled returns false if the package is disabled, see Enabled
+func (p *Package) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// HasTag returns true if the package has any of the given tags
+func (p *Package) HasTag(tags ...string) bool {
+	for _, tag := range tags {
+		for _, t := range p.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Tags returns all the tags used in the config, sorted
+func (c *Config) Tags() []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, pkg := range c.Packages {
+		for _, tag := range pkg.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Profile returns the profile with the given name, or nil
+func (c *Config) Profile(name string) *Profile {
+	for _, profile := range c.Profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+	return nil
+}
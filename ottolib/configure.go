@@ -0,0 +1,157 @@
+package ottolib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ConfigureVars are what configure args can use as Go templates, like
+// --with-jobs={{.NumCPU}}. They also get {{env "FOO"}}, the value of FOO
+// in the package's build environment (ours if it's not set there).
+type ConfigureVars struct {
+	NumCPU  int
+	Prefix  string
+	Profile string
+	Package string
+}
+
+// configureFuncs are the functions configure arg templates can use,
+// given the build env
+func configureFuncs(env []string) template.FuncMap {
+	return template.FuncMap{
+		"env": func(key string) string {
+			return lookupEnv(env, key)
+		},
+	}
+}
+
+// parseConfigureArg parses a configure arg as a template, if it has one
+func parseConfigureArg(arg string, env []string) (*template.Template, error) {
+	if !strings.Contains(arg, "{{") {
+		return nil, nil
+	}
+	t, err := template.New(arg).Funcs(configureFuncs(env)).Option("missingkey=error").Parse(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configure arg %s: %w", arg, err)
+	}
+	return t, nil
+}
+
+// checkConfigureArgs makes sure templates in configure args parse
+func checkConfigureArgs(args []string) error {
+	for _, arg := range args {
+		if _, err := parseConfigureArg(arg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandConfigureArg evaluates the template in a configure arg, if any
+func expandConfigureArg(arg string, vars ConfigureVars, env []string) (string, error) {
+	t, err := parseConfigureArg(arg, env)
+	if err != nil || t == nil {
+		return arg, err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, vars)
+	if err != nil {
+		return "", fmt.Errorf("while expanding configure arg %s: %w", arg, err)
+	}
+	return buf.String(), nil
+}
+
+// unrecognizedMarker is how autoconf-generated configure scripts warn
+// about options they don't know, which they otherwise ignore:
+//
+//	configure: WARNING: unrecognized options: --enable-foo, --with-bar
+const unrecognizedMarker = "WARNING: unrecognized options: "
+
+// configureScanner is a writer that picks the options configure didn't
+// recognize, and the features it found, out of its output
+type configureScanner struct {
+	lock     sync.Mutex
+	partial  []byte
+	found    []string
+	features featureList
+}
+
+func (us *configureScanner) Write(p []byte) (int, error) {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	us.partial = append(us.partial, p...)
+	for {
+		i := bytes.IndexByte(us.partial, '\n')
+		if i < 0 {
+			break
+		}
+		us.scan(string(us.partial[:i]))
+		us.partial = us.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (us *configureScanner) scan(line string) {
+	us.features.scan(line)
+
+	i := strings.Index(line, unrecognizedMarker)
+	if i < 0 {
+		return
+	}
+	for _, opt := range strings.Split(line[i+len(unrecognizedMarker):], ",") {
+		opt = strings.TrimSpace(opt)
+		if opt != "" {
+			us.found = append(us.found, opt)
+		}
+	}
+}
+
+// done scans what's left of configure's output, once it's done
+func (us *configureScanner) done() {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	if len(us.partial) > 0 {
+		us.scan(string(us.partial))
+		us.partial = nil
+	}
+}
+
+// optionName is a configure option without its value: configure only
+// mentions those in its warnings
+func optionName(arg string) string {
+	if i := strings.Index(arg, "="); i >= 0 {
+		return arg[:i]
+	}
+	return arg
+}
+
+// checkUnrecognized warns about the options configure didn't recognize,
+// saying where they came from, or fails with StrictConfigure
+func (bu *build) checkUnrecognized(cmds *packageCommands, unrecognized []string) error {
+	if len(unrecognized) == 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, opt := range unrecognized {
+		line := fmt.Sprintf("%s (not passed by otto)", opt)
+		if origins := cmds.configureOrigins[opt]; len(origins) > 0 {
+			line = fmt.Sprintf("%s (from %s)", opt, strings.Join(origins, ", "))
+		}
+		lines = append(lines, line)
+		if !bu.opts.StrictConfigure {
+			bu.logger.Warnf("configure didn't recognize %s", line)
+		}
+	}
+
+	if bu.opts.StrictConfigure {
+		return fmt.Errorf("configure didn't recognize %s", strings.Join(lines, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package ottolib
+
+import (
+	"time"
+)
+
+// pastDeadline reports whether BuildOptions.Deadline has run out
+func (bu *build) pastDeadline() bool {
+	return !bu.deadline.IsZero() && time.Now().After(bu.deadline)
+}
+
+// outOfTime stops the build at pkg, the first package that didn't get
+// built in time, and says how to pick up from there
+func (bu *build) outOfTime(profile *Profile, pkg *Package, err error) error {
+	bu.logger.Warnf("Out of time (the deadline was %s), stopping at %s", bu.opts.Deadline, pkg.Name)
+	bu.logger.Infof("Resume with --resume %s --resume-profile %s to build the rest", pkg.Name, profile.Name)
+	return withCategory(FailureDeadline, err)
+}
@@ -0,0 +1,139 @@
+package ottolib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// builtinFormat reports whether otto (and tar) can decompress archives
+// of that format by themselves
+func builtinFormat(format string) bool {
+	switch format {
+	case "tar", "tar.gz", "tar.xz":
+		return true
+	default:
+		return false
+	}
+}
+
+// tarSuffix finds formats like "tar.zst" in URLs
+var tarSuffix = regexp.MustCompile(`\.(tar\.[A-Za-z0-9]+)\b`)
+
+// checkDecompressors fails on decompressors for formats otto handles
+// itself, or without a command
+func (c *Config) checkDecompressors() error {
+	for format, command := range c.Decompressors {
+		if builtinFormat(format) {
+			return fmt.Errorf("decompressors: %s archives are extracted by otto already", format)
+		}
+		if !strings.HasPrefix(format, "tar.") {
+			return fmt.Errorf("decompressors: %s isn't a tar.<something> format", format)
+		}
+		if len(strings.Fields(command)) == 0 {
+			return fmt.Errorf("decompressors: no command for %s", format)
+		}
+	}
+	return nil
+}
+
+// decompressor returns the command archives of format are piped
+// through, or nil if there's none
+func (bu *build) decompressor(format string) []string {
+	if builtinFormat(format) {
+		return nil
+	}
+	decompressor := strings.Fields(bu.config.Decompressors[format])
+	if len(decompressor) == 0 {
+		return nil
+	}
+	return decompressor
+}
+
+// openArchive returns a reader for the tarball inside archive, and a func
+// to call once done with it, that reports errors from the decompressor
+func (bu *build) openArchive(format string, archive string) (io.Reader, func() error, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decompressor := bu.decompressor(format)
+	if decompressor == nil {
+		r, err := decompress(format, file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return r, file.Close, nil
+	}
+
+	cmd := exec.CommandContext(bu.ctx, decompressor[0], decompressor[1:]...)
+	cmd.Stdin = file
+	cmd.Stderr = bu.stderr
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("while starting decompressor %s: %w", decompressor[0], err)
+	}
+
+	done := func() error {
+		// the rest of the tarball (tar padding, usually) isn't needed
+		io.Copy(ioutil.Discard, out)
+		err := cmd.Wait()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("decompressor %s: %w", decompressor[0], err)
+		}
+		return nil
+	}
+	return out, done, nil
+}
+
+// pipeUntar extracts archive by piping it through its decompressor into
+// tar, with args for a plain tarball read from stdin
+func (bu *build) pipeUntar(decompressor []string, tar *tarTool, archive string, dir string, args []string, env []string) error {
+	bu.logger.Infof("> %s < %s | %s %s", strings.Join(decompressor, " "), archive, tar.path, strings.Join(args, " "))
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fullEnv := mergeEnv(os.Environ(), env)
+	decomp := exec.CommandContext(bu.ctx, decompressor[0], decompressor[1:]...)
+	decomp.Stdin = file
+	decomp.Stderr = bu.stderr
+	decomp.Env = fullEnv
+	out, err := decomp.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	untar := exec.CommandContext(bu.ctx, tar.path, args...)
+	flush := bu.setupCommand(untar, dir, nil, fullEnv)
+	defer flush()
+	untar.Stdin = out
+
+	err = decomp.Start()
+	if err != nil {
+		return fmt.Errorf("while starting decompressor %s: %w", decompressor[0], err)
+	}
+	tarErr := untar.Run()
+	// tar may have stopped reading early (it failed, or the rest is tar
+	// padding), the decompressor would block writing to it forever
+	io.Copy(ioutil.Discard, out)
+	decompErr := decomp.Wait()
+	if decompErr != nil {
+		return fmt.Errorf("decompressor %s: %w", decompressor[0], decompErr)
+	}
+	return tarErr
+}
@@ -0,0 +1,93 @@
+package ottolib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// applyDefaults merges the config's Defaults into every package that
+// doesn't set those fields itself. It works on the JSON, before it's
+// parsed into a Config, so that a package explicitly setting a field to
+// an empty value ("Configure": []) keeps it empty instead of getting
+// the default.
+func applyDefaults(configBytes []byte) ([]byte, error) {
+	var top map[string]json.RawMessage
+	err := json.Unmarshal(configBytes, &top)
+	if err != nil || top == nil {
+		// parseConfig reports that
+		return configBytes, nil
+	}
+
+	defaultsKey, packagesKey := jsonKey(top, "Defaults"), jsonKey(top, "Packages")
+	if defaultsKey == "" || packagesKey == "" {
+		return configBytes, nil
+	}
+
+	var defaults map[string]json.RawMessage
+	err = json.Unmarshal(top[defaultsKey], &defaults)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing defaults: %w", err)
+	}
+	err = checkDefaults(top[defaultsKey], defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []map[string]json.RawMessage
+	err = json.Unmarshal(top[packagesKey], &packages)
+	if err != nil {
+		// parseConfig reports that too
+		return configBytes, nil
+	}
+
+	for _, pkg := range packages {
+		for key, value := range defaults {
+			// encoding/json doesn't care about case, neither do we
+			if jsonKey(pkg, key) == "" {
+				pkg[key] = value
+			}
+		}
+	}
+
+	top[packagesKey], err = json.Marshal(packages)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(top)
+}
+
+// jsonKey returns the key of obj that encoding/json would match with
+// the field name, or ""
+func jsonKey(obj map[string]json.RawMessage, field string) string {
+	if _, ok := obj[field]; ok {
+		return field
+	}
+	for key := range obj {
+		if strings.EqualFold(key, field) {
+			return key
+		}
+	}
+	return ""
+}
+
+// checkDefaults fails on defaults that aren't package fields, or that
+// can't be shared by packages
+func checkDefaults(raw json.RawMessage, defaults map[string]json.RawMessage) error {
+	for key := range defaults {
+		for _, unique := range []string{"Name", "Sources", "Checksum"} {
+			if strings.EqualFold(key, unique) {
+				return fmt.Errorf("defaults: %s can't have a default, it's different for every package", unique)
+			}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&Package{})
+	if err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package ottolib
+
+import "fmt"
+
+// resolveDeps returns the named packages along with everything they
+// (transitively) depend on, ordered so that deps come before dependents.
+func resolveDeps(config *Config, names []string) ([]*Package, error) {
+	byName := make(map[string]*Package)
+	for _, pkg := range config.Packages {
+		byName[pkg.Name] = pkg
+	}
+
+	var ordered []*Package
+	done := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle involving %s", name)
+		}
+
+		pkg, ok := byName[name]
+		if !ok {
+			if from == "" {
+				return fmt.Errorf("unknown package %s", name)
+			}
+			return fmt.Errorf("%s depends on unknown package %s", from, name)
+		}
+
+		visiting[name] = true
+		for _, dep := range pkg.allDeps() {
+			err := visit(dep, name)
+			if err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+
+		done[name] = true
+		ordered = append(ordered, pkg)
+		return nil
+	}
+
+	for _, name := range names {
+		err := visit(name, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
@@ -0,0 +1,491 @@
+package ottolib
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// DownloadOptions controls how archives are downloaded, both when
+// building and fetching
+type DownloadOptions struct {
+	// Retries is how many times a failed or corrupt download is retried
+	Retries int
+	// MaxArchiveSize, if non-zero, is the largest archive we'll download, in bytes
+	MaxArchiveSize int64
+	// MaxRedirects is how many redirects to follow per download,
+	// 0 for the default (10), or negative to follow none
+	MaxRedirects int
+	// NoCrossHostRedirect refuses redirects to a host other than
+	// the one the download started with
+	NoCrossHostRedirect bool
+	// ConnectTimeout, if non-zero, is how long connecting to a server
+	// can take, so that dead mirrors fail fast
+	ConnectTimeout time.Duration
+	// ReadTimeout, if non-zero, is how long a server can go without
+	// sending anything, whether it's the response headers or more of the
+	// body. It's reset by every bit of progress, so slow but steady
+	// downloads can take as long as they need.
+	ReadTimeout time.Duration
+	// CacheDir, if set, is where archives are kept between builds, by
+	// URL and checksum, whatever the outdir. Several otto processes can
+	// share it.
+	CacheDir string
+	// UserAgent is the User-Agent downloads send, DefaultUserAgent if
+	// empty. HostUserAgents overrides it for some hosts, which can be
+	// patterns as in pins (*.example.org).
+	UserAgent      string
+	HostUserAgents map[string]string
+	// AllowedHosts, if set, are the only hosts (or host patterns) to
+	// download from, on top of the config's AllowedHosts
+	AllowedHosts []string
+	// ChecksumFile, if set, is where the checksums of archives without
+	// one in the config are recorded when they're first downloaded, and
+	// verified against from then on, so that upstream archives changing
+	// under our feet fail builds
+	ChecksumFile string
+	// ForceDownload downloads archives even when there's one with the
+	// right checksum already, or one the server says hasn't changed
+	ForceDownload bool
+	// MaxPerHost, if non-zero, is how many downloads can be going on at
+	// once from any one host, so that downloading ahead of the build
+	// (see BuildOptions.ExtractJobs) doesn't get us throttled by mirrors
+	MaxPerHost int
+	// AllowNonArchives keeps downloads that look like web pages or
+	// other text rather than archives, which otherwise fail right away
+	AllowNonArchives bool
+}
+
+// fetchPackage downloads a package's archive to dest, trying its sources
+// then its mirrors in turn, and verifying the checksum if one is specified.
+// Corrupt or failed downloads are removed and retried, up to Download.Retries times.
+// Packages without a checksum get a recorded one, see Download.ChecksumFile.
+func (bu *build) fetchPackage(pkg *Package, dest string, res *PackageResult) error {
+	if bu.recorded != nil && pkg.Checksum == "" && !isLocalDir(pkg) {
+		return bu.fetchRecorded(pkg, dest, res)
+	}
+	return bu.fetchSources(pkg, dest, res)
+}
+
+// fetchSources is fetchPackage, minus recorded checksums
+func (bu *build) fetchSources(pkg *Package, dest string, res *PackageResult) error {
+	if p, ok := localPath(pkg.Sources); ok {
+		return bu.fetchLocal(pkg, p, dest)
+	}
+	if bu.opts.SourceDir != "" {
+		return bu.fetchFromSourceDir(pkg, dest)
+	}
+	if bu.opts.Download.CacheDir != "" {
+		return bu.fetchCached(pkg, dest, res)
+	}
+	if bu.opts.Offline {
+		return bu.useCached(pkg, dest)
+	}
+
+	// packages can share sources (e.g. static and shared builds
+	// of the same thing), no need to download those twice
+	key := pkg.Sources + "#" + pkg.Checksum
+	bu.downloadedLock.Lock()
+	previous, ok := bu.downloaded[key]
+	bu.downloadedLock.Unlock()
+	if ok {
+		if _, err := os.Stat(previous); err == nil {
+			if previous == dest {
+				// the package is being retried, see Package.Retries
+				bu.logger.Infof("Reusing %s, already downloaded", dest)
+				res.CacheHit = true
+				return nil
+			}
+			bu.logger.Infof("Reusing %s, already downloaded for another package", previous)
+			res.CacheHit = true
+			return linkOrCopy(previous, dest)
+		}
+	}
+
+	err := bu.downloadPackage(pkg, dest, res)
+	if err != nil {
+		return err
+	}
+
+	bu.downloadedLock.Lock()
+	bu.downloaded[key] = dest
+	bu.downloadedLock.Unlock()
+	return nil
+}
+
+// downloadPackage does the actual downloading for fetchPackage, unless
+// dest is already there and matches the package's checksum
+func (bu *build) downloadPackage(pkg *Package, dest string, res *PackageResult) error {
+	if pkg.Checksum != "" && !bu.opts.Download.ForceDownload {
+		if _, err := os.Stat(dest); err == nil {
+			err = bu.verifyChecksum(dest, pkg.Checksum)
+			if err == nil {
+				bu.logger.Infof("Already have %s, not downloading it again", dest)
+				res.CacheHit = true
+				return nil
+			}
+			bu.logger.Infof("Downloading %s again: %s", pkg.Name, err)
+		}
+	}
+
+	urls := append([]string{pkg.Sources}, pkg.Mirrors...)
+
+	header, err := authHeader(pkg.Auth)
+	if err != nil {
+		return fmt.Errorf("while setting up auth for %s: %w", pkg.Name, err)
+	}
+	attempts := 1 + bu.opts.Download.Retries
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		url := urls[attempt%len(urls)]
+		if attempt > 0 {
+			bu.logger.Warnf("Retrying download (attempt %d/%d) from %s", attempt+1, attempts, url)
+		}
+
+		if len(pkg.ResolverCommand) > 0 {
+			lastErr = bu.resolve(pkg, url, dest, res)
+		} else {
+			lastErr = bu.download(url, dest, header, pkg.Checksum, res)
+		}
+		if lastErr == nil {
+			return nil
+		}
+
+		bu.logger.Warnf("Download from %s failed: %s", url, lastErr)
+
+		// don't leave a corrupt archive around for anyone to pick up
+		for _, p := range []string{dest, partPath(dest)} {
+			err = os.Remove(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		removeValidators(dest)
+	}
+
+	return fmt.Errorf("giving up after %d download attempts: %w", attempts, lastErr)
+}
+
+// partPath is where the archive at dest is downloaded to, until it's
+// complete and verified
+func partPath(dest string) string {
+	return dest + ".part"
+}
+
+// download downloads url to dest. It goes to a .part file first, which
+// is only renamed to dest once it's complete and matches checksum, so
+// that an archive at dest is always a whole one.
+func (bu *build) download(url string, dest string, header http.Header, checksum string, res *PackageResult) error {
+	bu.logger.Infof("Downloading from %s", url)
+
+	err := bu.checkHost(url)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(bu.ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if bu.hostSlots != nil {
+		release, err := bu.hostSlots.acquire(ctx, bu.logger, url)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	var validators *httpValidators
+	if !bu.opts.Download.ForceDownload {
+		validators = readValidators(dest, url)
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	resp, err := bu.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res.URL = resp.Request.URL.String()
+	if res.URL != url {
+		bu.logger.Infof("Redirected to %s", res.URL)
+	}
+
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		bu.logger.Infof("Not modified since last download, keeping %s", dest)
+		res.CacheHit = true
+		return bu.verifyChecksum(dest, checksum)
+	}
+
+	if resp.StatusCode != 200 {
+		err := fmt.Errorf("HTTP %d for %s", resp.StatusCode, url)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			// retrying won't make it appear
+			err = withCategory(FailureConfig, err)
+		}
+		return err
+	}
+
+	maxSize := bu.opts.Download.MaxArchiveSize
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return withCategory(FailureConfig, fmt.Errorf("%s is %s, more than the maximum archive size of %s", url,
+			humanize.IBytes(uint64(resp.ContentLength)), humanize.IBytes(uint64(maxSize))))
+	}
+
+	humanSize := "? bytes"
+	if resp.ContentLength > 0 {
+		humanSize = humanize.IBytes(uint64(resp.ContentLength))
+	}
+	bu.logger.Infof("Downloading %s", humanSize)
+
+	part := partPath(dest)
+	writer, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	var w io.Writer = writer
+	if maxSize > 0 {
+		// the server might be lying about the length, or not telling at all
+		w = &sizeGuardWriter{w: writer, max: maxSize}
+	}
+
+	var body io.Reader = resp.Body
+	var stall *stallReader
+	if timeout := bu.opts.Download.ReadTimeout; timeout > 0 {
+		stall = newStallReader(resp.Body, timeout, cancel)
+		defer stall.stop()
+		body = stall
+	}
+
+	if !bu.opts.Download.AllowNonArchives {
+		buffered := bufio.NewReaderSize(body, sniffLen)
+		// Peek fails on archives smaller than that, which is fine
+		head, _ := buffered.Peek(sniffLen)
+		if contentType := notAnArchive(resp, head); contentType != "" {
+			return withCategory(FailureConfig, fmt.Errorf("downloaded %s from %s, not an archive (a download page or a login wall?)",
+				contentType, res.URL))
+		}
+		body = buffered
+	}
+
+	n, err := io.Copy(w, body)
+	res.BytesDownloaded += n
+	if err != nil {
+		if stall != nil && stall.stalled() {
+			return fmt.Errorf("download stalled: nothing received for %s", bu.opts.Download.ReadTimeout)
+		}
+		return fmt.Errorf("while downloading: %w", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	err = bu.verifyChecksum(part, checksum)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(part, dest)
+	if err != nil {
+		return fmt.Errorf("while moving download into place: %w", err)
+	}
+
+	return writeValidators(dest, &httpValidators{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+}
+
+// sniffLen is how much of a download notAnArchive looks at
+const sniffLen = 512
+
+// notAnArchive returns the type of a download if it looks like a web
+// page or some other text: archives are binary, whatever the server says
+// they are. It returns "" for anything else.
+func notAnArchive(resp *http.Response, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if !strings.HasPrefix(sniffed, "text/") {
+		return ""
+	}
+
+	// what the server says is more helpful in error messages, if it's text too
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && (strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+xml") || mediaType == "application/json") {
+		return mediaType
+	}
+	return strings.SplitN(sniffed, ";", 2)[0]
+}
+
+// sizeGuardWriter fails writes that would take the total past max bytes
+type sizeGuardWriter struct {
+	w       io.Writer
+	written int64
+	max     int64
+}
+
+func (sgw *sizeGuardWriter) Write(p []byte) (int, error) {
+	if sgw.written+int64(len(p)) > sgw.max {
+		return 0, withCategory(FailureConfig, fmt.Errorf("archive exceeds maximum size of %s", humanize.IBytes(uint64(sgw.max))))
+	}
+
+	n, err := sgw.w.Write(p)
+	sgw.written += int64(n)
+	return n, err
+}
+
+// stallReader cancels a download when reading from it blocks for longer
+// than timeout, which http.Client.Timeout can't do: that one's for the
+// whole download, however fast it's going.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel func()) *stallReader {
+	sr := &stallReader{r: r, timeout: timeout}
+	sr.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&sr.fired, 1)
+		cancel()
+	})
+	return sr
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.timer.Reset(sr.timeout)
+	}
+	return n, err
+}
+
+func (sr *stallReader) stalled() bool {
+	return atomic.LoadInt32(&sr.fired) == 1
+}
+
+func (sr *stallReader) stop() {
+	sr.timer.Stop()
+}
+
+// parseChecksum splits a checksum of the form "algo:hex" into
+// a hash and its expected hex digest. A bare hex digest is taken to be sha256.
+func parseChecksum(checksum string) (hash.Hash, string, error) {
+	algo := "sha256"
+	digest := checksum
+	if i := strings.Index(checksum, ":"); i >= 0 {
+		algo = checksum[:i]
+		digest = checksum[i+1:]
+	}
+	digest = strings.ToLower(digest)
+
+	switch algo {
+	case "sha1":
+		return sha1.New(), digest, nil
+	case "sha256":
+		return sha256.New(), digest, nil
+	case "sha512":
+		return sha512.New(), digest, nil
+	default:
+		return nil, "", fmt.Errorf("checksum: unknown algorithm %s", algo)
+	}
+}
+
+// checksumMatches hashes the file at path and reports whether it matches checksum
+func checksumMatches(path string, checksum string) (bool, error) {
+	_, expected, err := parseChecksum(checksum)
+	if err != nil {
+		return false, err
+	}
+
+	computed, err := computeChecksum(path, checksum)
+	if err != nil {
+		return false, err
+	}
+
+	return computed == expected, nil
+}
+
+// computeChecksum returns the hex digest of the file at path, using
+// the same algorithm as checksum
+func computeChecksum(path string, checksum string) (string, error) {
+	h, _, err := parseChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyChecksum hashes the file at path and compares it against checksum.
+// An empty checksum always passes.
+func (bu *build) verifyChecksum(path string, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	_, expected, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	computed, err := computeChecksum(path, checksum)
+	if err != nil {
+		return err
+	}
+
+	if computed != expected {
+		return fmt.Errorf("%w for %s: expected %s, computed %s", errChecksumMismatch, path, expected, computed)
+	}
+
+	bu.logger.Infof("Checksum OK (%s)", computed)
+	return nil
+}
@@ -0,0 +1,207 @@
+package ottolib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// buildEnv returns the variables a package is built with, on top
+// of the inherited environment, as KEY=value pairs, or just KEY for
+// variables UnsetEnv removes (see mergeEnv). inherited are the
+// prefixes of earlier packages, when they each have their own.
+func (bu *build) buildEnv(profile *Profile, pkg *Package, prefix string, inherited []string, expand func(string) string) []string {
+	env := []string{}
+	env = append(env, profile.UnsetEnv...)
+	for k, v := range profile.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, expand(v)))
+	}
+	env = append(env, pkg.UnsetEnv...)
+	for k, v := range pkg.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, expand(v)))
+	}
+	env = append(env, fmt.Sprintf("PREFIX=%s", prefix))
+
+	// the most recently built packages come first in search paths
+	prefixes := []string{prefix}
+	for i := len(inherited) - 1; i >= 0; i-- {
+		prefixes = append(prefixes, inherited[i])
+	}
+
+	pkgConfig := fmt.Sprintf("%s/lib/pkgconfig", prefix)
+	for _, p := range prefixes[1:] {
+		pkgConfig = fmt.Sprintf("%s:%s/lib/pkgconfig", pkgConfig, p)
+	}
+	for _, v := range profile.Pkgconfig {
+		pkgConfig = fmt.Sprintf("%s:%s", pkgConfig, v)
+	}
+	env = append(env, fmt.Sprintf("PKG_CONFIG_PATH=%s", pkgConfig))
+
+	if !bu.opts.NoPrefixPath {
+		// so that tools built by earlier packages (pkg-config, nasm...)
+		// can be found by later ones
+		var dirs []string
+		for _, p := range prefixes {
+			dirs = append(dirs, filepath.Join(p, "bin"))
+		}
+		path := strings.Join(dirs, string(os.PathListSeparator))
+		if existing := lookupEnv(env, "PATH"); existing != "" {
+			path = path + string(os.PathListSeparator) + existing
+		}
+		env = append(env, fmt.Sprintf("PATH=%s", path))
+	}
+
+	if len(inherited) > 0 {
+		// CPPFLAGS rather than CFLAGS, so as not to override
+		// configure's default optimization flags
+		cppflags := lookupEnv(env, "CPPFLAGS")
+		ldflags := lookupEnv(env, "LDFLAGS")
+		for _, p := range prefixes[1:] {
+			cppflags = strings.TrimSpace(fmt.Sprintf("%s -I%s/include", cppflags, p))
+			ldflags = strings.TrimSpace(fmt.Sprintf("%s -L%s/lib", ldflags, p))
+		}
+		env = append(env, "CPPFLAGS="+cppflags, "LDFLAGS="+ldflags)
+	}
+
+	env = append(env, bu.compilerCacheEnv(profile, pkg, env)...)
+
+	return env
+}
+
+// mergeEnv returns base with the variables in env on top. Entries of
+// env without an "=" are variables to unset: they're removed from
+// whatever comes before them.
+func mergeEnv(base []string, env []string) []string {
+	merged := append([]string{}, base...)
+	for _, kv := range env {
+		if strings.Contains(kv, "=") {
+			merged = append(merged, kv)
+			continue
+		}
+		kept := merged[:0]
+		for _, existing := range merged {
+			if !strings.HasPrefix(existing, kv+"=") {
+				kept = append(kept, existing)
+			}
+		}
+		merged = kept
+	}
+	return merged
+}
+
+// checkUnsetEnv fails on UnsetEnv entries that aren't variable names
+func checkUnsetEnv(names []string) error {
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("invalid variable name %q in UnsetEnv", name)
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the last value of key in env (a list of KEY=value pairs),
+// falling back to the inherited environment unless key is unset in env
+func lookupEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if env[i] == key {
+			return ""
+		}
+		if strings.HasPrefix(env[i], key+"=") {
+			return strings.TrimPrefix(env[i], key+"=")
+		}
+	}
+	return os.Getenv(key)
+}
+
+// lookPath is like exec.LookPath, but searches the PATH in env (so that
+// tools installed in the prefix are found), falling back to ours
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return exec.LookPath(file)
+	}
+
+	for _, dir := range filepath.SplitList(lookupEnv(env, "PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, file)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH", file)
+}
+
+// compilerCacheEnv returns the variables needed to route CC and CXX
+// through the profile's compiler cache, if it has one and it's installed
+func (bu *build) compilerCacheEnv(profile *Profile, pkg *Package, env []string) []string {
+	if profile.Compiler == "" || pkg.NoCompilerCache {
+		return nil
+	}
+
+	var cacheDirVar string
+	switch profile.Compiler {
+	case "ccache":
+		cacheDirVar = "CCACHE_DIR"
+	case "sccache":
+		cacheDirVar = "SCCACHE_DIR"
+	default:
+		bu.logger.Warnf("Unknown compiler cache %s, ignoring", profile.Compiler)
+		return nil
+	}
+
+	wrapper, err := exec.LookPath(profile.Compiler)
+	if err != nil {
+		bu.logger.Warnf("%s not found in PATH, building without it", profile.Compiler)
+		return nil
+	}
+
+	cacheDir := profile.CompilerCacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(bu.opts.OutDir, "cache", profile.Compiler)
+	}
+
+	cc := lookupEnv(env, "CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	cxx := lookupEnv(env, "CXX")
+	if cxx == "" {
+		cxx = "c++"
+	}
+
+	return []string{
+		fmt.Sprintf("CC=%s %s", wrapper, cc),
+		fmt.Sprintf("CXX=%s %s", wrapper, cxx),
+		fmt.Sprintf("%s=%s", cacheDirVar, cacheDir),
+	}
+}
+
+// configCacheVars are the variables whose values invalidate a shared
+// autoconf cache when they change
+var configCacheVars = []string{"CC", "CXX", "CPP", "CFLAGS", "CXXFLAGS", "CPPFLAGS", "LDFLAGS", "LIBS", "PKG_CONFIG_PATH"}
+
+// configCachePath returns the autoconf cache file for a profile, with
+// a hash of the toolchain settings in env mixed into its name
+func (bu *build) configCachePath(profile *Profile, env []string) string {
+	h := sha256.New()
+	for _, key := range configCacheVars {
+		fmt.Fprintf(h, "%s=%s\n", key, lookupEnv(env, key))
+	}
+	for _, arg := range profile.Configure {
+		fmt.Fprintf(h, "%s\n", arg)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))[:12]
+
+	p := profile.ConfigCache
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(bu.opts.OutDir, "src", profile.Name, p)
+	}
+
+	ext := filepath.Ext(p)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(p, ext), sum, ext)
+}
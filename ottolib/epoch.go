@@ -0,0 +1,48 @@
+package ottolib
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpochArchive, as a profile's SourceDateEpoch, derives it
+// from the newest file in each package's archive
+const SourceDateEpochArchive = "archive"
+
+// sourceDateEpoch returns the SOURCE_DATE_EPOCH to build a package
+// with, or "" if there's none to set. The build options win over the
+// profile, see https://reproducible-builds.org/specs/source-date-epoch/
+func (bu *build) sourceDateEpoch(profile *Profile, pkg *Package, format string, archive string) (string, error) {
+	if bu.opts.SourceDateEpoch > 0 {
+		return strconv.FormatInt(bu.opts.SourceDateEpoch, 10), nil
+	}
+
+	switch profile.SourceDateEpoch {
+	case "":
+		return "", nil
+	case SourceDateEpochArchive:
+		if len(pkg.ExtractCommand) > 0 || format == FormatDir {
+			bu.logger.Warnf("Can't look inside %s archives, not setting SOURCE_DATE_EPOCH", pkg.Name)
+			return "", nil
+		}
+
+		// the archive file's own mtime is just when we downloaded it
+		var newest time.Time
+		err := bu.scanArchive(format, archive, func(hdr *tar.Header) {
+			if hdr.ModTime.After(newest) {
+				newest = hdr.ModTime
+			}
+		})
+		if err != nil {
+			return "", fmt.Errorf("while looking for the newest file in %s: %w", archive, err)
+		}
+		if newest.IsZero() {
+			return "", nil
+		}
+		return strconv.FormatInt(newest.Unix(), 10), nil
+	default:
+		return profile.SourceDateEpoch, nil
+	}
+}
@@ -0,0 +1,397 @@
+package ottolib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FormatCustom is the format of packages that are extracted with their
+// ExtractCommand, when it's not given or can't be guessed
+const FormatCustom = "archive"
+
+// formatForPackage returns the archive format of a package, guessing
+// it from the sources URL if it's not specified explicitly
+func formatForPackage(pkg *Package) (string, error) {
+	if pkg.Format != "" {
+		return pkg.Format, nil
+	}
+
+	if isLocalDir(pkg) {
+		return FormatDir, nil
+	}
+
+	if strings.Contains(pkg.Sources, ".tar.xz") {
+		return "tar.xz", nil
+	} else if strings.Contains(pkg.Sources, ".tar.gz") {
+		return "tar.gz", nil
+	}
+
+	if len(pkg.ExtractCommand) > 0 {
+		// only the archive's name depends on it then
+		return FormatCustom, nil
+	}
+
+	// those need a decompressor, see Config.Decompressors
+	if m := tarSuffix.FindStringSubmatch(pkg.Sources); m != nil {
+		return m[1], nil
+	}
+
+	return "", fmt.Errorf("could not figure out format of %s, please specify explicitly", pkg.Sources)
+}
+
+// archiveName is what a package's archive is called once downloaded:
+// its Filename if set, the basename of its URL with UpstreamFilenames,
+// and <name>.<format> otherwise
+func (bu *build) archiveName(pkg *Package, format string) string {
+	if pkg.Filename != "" {
+		return pkg.Filename
+	}
+
+	if bu.opts.UpstreamFilenames {
+		if u, err := url.Parse(pkg.Sources); err == nil {
+			base := path.Base(u.Path)
+			if base != "." && base != "/" {
+				return base
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s.%s", pkg.Name, format)
+}
+
+// extractedMarker is written in a package's source dir once everything
+// has been extracted into it, so that an interrupted extraction can be
+// told apart from a finished one
+const extractedMarker = ".otto-extracted"
+
+// cleanPartialExtract removes what an interrupted extraction left in
+// pkgSrc, if the marker says it didn't finish. The archives themselves
+// (named in keep) are left alone, along with their validators. The
+// marker is removed either way, until the extraction is done again.
+func (bu *build) cleanPartialExtract(pkgSrc string, keep []string) error {
+	marker := filepath.Join(pkgSrc, extractedMarker)
+	_, err := os.Stat(marker)
+	if err == nil {
+		return os.Remove(marker)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, name := range keep {
+		kept[name] = true
+		kept[filepath.Base(validatorsPath(name))] = true
+	}
+
+	files, err := ioutil.ReadDir(pkgSrc)
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	for _, f := range files {
+		if kept[f.Name()] && !f.IsDir() {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(pkgSrc, f.Name()))
+		if err != nil {
+			return fmt.Errorf("while removing partial extraction: %w", err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		bu.logger.Warnf("Removed %d entries left by an incomplete extraction in %s", removed, pkgSrc)
+	}
+	return nil
+}
+
+// markExtracted records that everything was extracted into pkgSrc
+func markExtracted(pkgSrc string) error {
+	return ioutil.WriteFile(filepath.Join(pkgSrc, extractedMarker), nil, 0644)
+}
+
+// extract unpacks archive into pkgSrc and returns the directory
+// the package should be built from
+func (bu *build) extract(pkg *Package, format string, archive string, pkgSrc string, env []string) (string, error) {
+	if format == FormatDir {
+		dest := filepath.Join(pkgSrc, filepath.Base(archive))
+		if canonical := pkg.canonicalDir(); canonical != "" {
+			dest = filepath.Join(pkgSrc, canonical)
+		}
+		err := bu.copyLocalDir(archive, dest)
+		if err != nil {
+			return "", err
+		}
+		if pkg.SourceDir != "" {
+			return filepath.Join(dest, pkg.SourceDir), nil
+		}
+		return dest, nil
+	}
+
+	bu.logger.Infof("Extracting...")
+	var err error
+	if len(pkg.ExtractCommand) > 0 {
+		err = bu.customExtract(pkg, archive, pkgSrc, env)
+	} else {
+		err = bu.untar(format, archive, pkgSrc, 0, pkg.ExtractInclude, pkg.ExtractExclude, env)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if pkg.SourceDir != "" {
+		dir := filepath.Join(pkgSrc, pkg.SourceDir)
+		stats, err := os.Stat(dir)
+		if err != nil || !stats.IsDir() {
+			return "", fmt.Errorf("source dir %s not found after extraction", pkg.SourceDir)
+		}
+		return dir, nil
+	}
+
+	if pkg.Flat {
+		return pkgSrc, nil
+	}
+
+	files, err := ioutil.ReadDir(pkgSrc)
+	if err != nil {
+		return "", err
+	}
+
+	canonical := pkg.canonicalDir()
+	var dirs []string
+	hasCanonical := false
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		if f.Name() == canonical {
+			// the archive's own, or from an earlier build
+			hasCanonical = true
+			continue
+		}
+		dirs = append(dirs, f.Name())
+	}
+
+	if len(dirs) > 1 && len(pkg.ExtractCommand) == 0 {
+		dirs = bu.archiveDirs(format, archive, dirs)
+	}
+
+	if hasCanonical && len(dirs) == 0 {
+		return filepath.Join(pkgSrc, canonical), nil
+	}
+	if canonical != "" && len(dirs) == 1 {
+		return bu.normalizeDir(pkgSrc, dirs[0], canonical)
+	}
+
+	switch len(dirs) {
+	case 0:
+		return "", fmt.Errorf("no directory found in %s after extraction (set flat if the archive has none)", pkgSrc)
+	case 1:
+		return filepath.Join(pkgSrc, dirs[0]), nil
+	default:
+		// picking one would be a guess
+		return "", fmt.Errorf("found %d directories in %s after extraction (%s), set sourcedir to the one to build from",
+			len(dirs), pkgSrc, strings.Join(dirs, ", "))
+	}
+}
+
+// archiveDirs narrows dirs, the directories found in a package's source
+// dir after extracting archive, down to those the archive has members
+// in. The others are left from extracting an earlier version of the
+// package there, the tree isn't cleared so that what was built is kept.
+func (bu *build) archiveDirs(format string, archive string, dirs []string) []string {
+	top := make(map[string]bool)
+	err := bu.scanArchive(format, archive, func(hdr *tar.Header) {
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		top[strings.SplitN(name, "/", 2)[0]] = true
+	})
+	if err != nil {
+		bu.logger.Warnf("Couldn't list the directories in %s: %s", archive, err)
+		return dirs
+	}
+
+	var ours []string
+	for _, dir := range dirs {
+		if top[dir] {
+			ours = append(ours, dir)
+		}
+	}
+	if len(ours) == 0 {
+		return dirs
+	}
+	return ours
+}
+
+// normalizeDir renames dir, which an archive extracted to in pkgSrc, to
+// canonical (see Package.NormalizeDir). If canonical is already there from
+// an earlier build, dir's contents are moved into it instead, the way
+// extracting over a tree would, so that what was built in it is kept.
+func (bu *build) normalizeDir(pkgSrc string, dir string, canonical string) (string, error) {
+	from, dest := filepath.Join(pkgSrc, dir), filepath.Join(pkgSrc, canonical)
+	bu.logger.Infof("Renaming %s to %s", dir, canonical)
+
+	_, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		err = os.Rename(from, dest)
+	} else if err == nil {
+		err = moveInto(from, dest)
+	}
+	if err != nil {
+		return "", fmt.Errorf("while renaming %s to %s: %w", dir, canonical, err)
+	}
+	return dest, nil
+}
+
+// moveInto moves everything in src into the dir dest, replacing what's
+// there, then removes src
+func moveInto(src string, dest string) error {
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		existing, err := os.Lstat(target)
+		if err == nil && existing.IsDir() != info.IsDir() {
+			err = os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+		}
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return os.Rename(p, target)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// extractExtra unpacks an extra source's archive into dest, stripping
+// its top-level directory unless it's flat
+func (bu *build) extractExtra(extraPkg *Package, format string, archive string, dest string, env []string) error {
+	if format == FormatDir {
+		return bu.copyLocalDir(archive, dest)
+	}
+
+	bu.logger.Infof("Extracting %s into %s...", filepath.Base(archive), dest)
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	strip := 1
+	if extraPkg.Flat {
+		strip = 0
+	}
+
+	return bu.untar(format, archive, dest, strip, nil, nil, env)
+}
+
+// customExtract runs a package's ExtractCommand in pkgSrc, after
+// replacing $ARCHIVE and $DEST in it
+func (bu *build) customExtract(pkg *Package, archive string, pkgSrc string, env []string) error {
+	replacer := strings.NewReplacer("$ARCHIVE", archive, "$DEST", pkgSrc)
+
+	for _, argv := range pkg.ExtractCommand {
+		if len(argv) == 0 {
+			continue
+		}
+
+		args := make([]string, len(argv))
+		for i, arg := range argv {
+			args[i] = replacer.Replace(arg)
+		}
+
+		err := bu.command(pkgSrc, args[0], env, args[1:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// customVerify runs a package's VerifyCommand in pkgSrc, after
+// replacing $ARCHIVE in it
+func (bu *build) customVerify(pkg *Package, archive string, pkgSrc string, env []string) error {
+	for _, argv := range pkg.VerifyCommand {
+		if len(argv) == 0 {
+			continue
+		}
+
+		args := make([]string, len(argv))
+		for i, arg := range argv {
+			args[i] = strings.Replace(arg, "$ARCHIVE", archive, -1)
+		}
+
+		err := bu.command(pkgSrc, args[0], env, args[1:]...)
+		if err != nil {
+			return fmt.Errorf("verify command %s failed: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+// untar extracts archive into dir, with the tar binary or natively
+// depending on the build options, through the format's decompressor if
+// it has one
+func (bu *build) untar(format string, archive string, dir string, strip int, include []string, exclude []string, env []string) error {
+	if bu.opts.NativeExtract {
+		return bu.nativeExtract(format, archive, dir, strip, include, exclude)
+	}
+
+	tar, err := bu.tar()
+	if err != nil {
+		return err
+	}
+
+	if decompressor := bu.decompressor(format); decompressor != nil {
+		args, err := tar.extractArgs("tar", "-", dir, strip, include, exclude)
+		if err != nil {
+			return err
+		}
+		return bu.pipeUntar(decompressor, tar, archive, dir, args, env)
+	}
+
+	args, err := tar.extractArgs(format, archive, dir, strip, include, exclude)
+	if err != nil {
+		return err
+	}
+
+	return bu.command(dir, tar.path, env, args...)
+}
+
+// lazyTar is the tar binary a build extracts with, once it's been found
+type lazyTar struct {
+	once sync.Once
+	tool *tarTool
+	err  error
+}
+
+// tar returns the tar binary to extract with, looking for it
+// the first time around
+func (bu *build) tar() (*tarTool, error) {
+	ft := bu.foundTar
+	ft.once.Do(func() {
+		ft.tool, ft.err = findTar(bu.opts.Tar)
+		if ft.err == nil {
+			bu.logger.Debugf("Extracting with %s (%s tar)", ft.tool.path, ft.tool.flavor)
+		}
+	})
+	return ft.tool, ft.err
+}
@@ -0,0 +1,129 @@
+package ottolib
+
+import (
+	"errors"
+	"net"
+)
+
+// Failure categories, telling transient failures (worth retrying the
+// whole job for) from deterministic ones. See ExitCode for the exit code
+// each one maps to.
+const (
+	// FailureNetwork is for downloads that failed on the way
+	FailureNetwork = "network"
+	// FailureTimeout is for packages killed after their Timeout
+	FailureTimeout = "timeout"
+	// FailureDeadline is for builds that ran out of time, see
+	// BuildOptions.Deadline
+	FailureDeadline = "deadline"
+	// FailureBuild is for packages that failed to extract, configure,
+	// build or install
+	FailureBuild = "build"
+	// FailureConfig is for problems with the config or the environment
+	// that no retry would fix: invalid configs, wrong checksums,
+	// missing tools, refused hosts, 404s
+	FailureConfig = "config"
+	// FailureOther is for everything else
+	FailureOther = "other"
+)
+
+// ExitCode returns the process exit code for a failure category. They're
+// stable: 10-19 are transient failures, 20 is a build failure and 30 is
+// a config failure.
+func ExitCode(category string) int {
+	switch category {
+	case "":
+		return 0
+	case FailureNetwork:
+		return 10
+	case FailureTimeout:
+		return 11
+	case FailureDeadline:
+		return 12
+	case FailureBuild:
+		return 20
+	case FailureConfig:
+		return 30
+	default:
+		return 1
+	}
+}
+
+// categorized is an error that knows which category it falls in
+type categorized struct {
+	category string
+	err      error
+}
+
+func (c *categorized) Error() string {
+	return c.err.Error()
+}
+
+func (c *categorized) Unwrap() error {
+	return c.err
+}
+
+func withCategory(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorized{category: category, err: err}
+}
+
+// categoryOf returns the category of an error that happened in the given
+// phase: the one it was given if any, or else guessed from the phase
+func categoryOf(phase string, err error) string {
+	var c *categorized
+	if errors.As(err, &c) {
+		return c.category
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return FailureNetwork
+	}
+
+	switch phase {
+	case "download":
+		return FailureNetwork
+	case "verify", "tools":
+		return FailureConfig
+	case "extract", "configure", "build", "install", "install check", "overwrites":
+		return FailureBuild
+	default:
+		return FailureOther
+	}
+}
+
+// FailureCategory returns the category the failures of the build fall
+// in: the most common among the failed packages, or buildErr's own if no
+// package failed, or FailureDeadline if it ran out of time. It's "" if
+// buildErr is nil.
+func (r *Result) FailureCategory(buildErr error) string {
+	if buildErr == nil {
+		return ""
+	}
+	if categoryOf("", buildErr) == FailureDeadline {
+		return FailureDeadline
+	}
+	if category, _ := r.dominantFailure(); category != "" {
+		return category
+	}
+	return categoryOf("", buildErr)
+}
+
+// dominantFailure returns the most common category among the failed
+// packages (the first of them wins ties) and how many fall in it
+func (r *Result) dominantFailure() (string, int) {
+	counts := make(map[string]int)
+	var dominant string
+	for _, pr := range r.Results {
+		if pr.Status != StatusFailed {
+			continue
+		}
+		counts[pr.Failure]++
+		if dominant == "" || counts[pr.Failure] > counts[dominant] {
+			dominant = pr.Failure
+		}
+	}
+	return dominant, counts[dominant]
+}
@@ -0,0 +1,123 @@
+package ottolib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Feature is an optional feature configure said it enabled or not, named
+// the way configure printed it: "checking for zlib... yes" is the
+// feature "for zlib", and "  HTTP/2 support: no" in the summary some
+// scripts print at the end is "HTTP/2 support".
+type Feature struct {
+	Name    string `json:"name" yaml:"name"`
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+}
+
+// featureList is the features in a configure script's output, in the
+// order they first showed up in
+type featureList []*Feature
+
+var (
+	checkingLine = regexp.MustCompile(`^checking (.+?)\.\.\. (?:\(cached\) )?(\S+)`)
+	summaryLine  = regexp.MustCompile(`^\s*([A-Za-z0-9][^:]*?)\s*:\s+(\S+)`)
+)
+
+// scan picks a feature out of a line of configure output, if there's
+// one. Only yes/no answers count, "checking for gcc... gcc" isn't one.
+func (fl *featureList) scan(line string) {
+	m := checkingLine.FindStringSubmatch(line)
+	if m == nil {
+		m = summaryLine.FindStringSubmatch(line)
+	}
+	if m == nil {
+		return
+	}
+
+	enabled, ok := featureValue(m[2])
+	if !ok {
+		return
+	}
+
+	// summaries come last, and know best
+	for _, f := range *fl {
+		if f.Name == m[1] {
+			f.Enabled = enabled
+			return
+		}
+	}
+	*fl = append(*fl, &Feature{Name: m[1], Enabled: enabled})
+}
+
+func featureValue(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimRight(value, ".,;")) {
+	case "yes", "enabled", "on", "true":
+		return true, true
+	case "no", "disabled", "off", "false", "none":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func (fl featureList) find(name string) *Feature {
+	for _, f := range fl {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// checkFeatures fails if configure didn't enable (or disable) the
+// features the package expects it to, or didn't mention them at all
+func checkFeatures(pkg *Package, features featureList) error {
+	var names []string
+	for name := range pkg.ExpectFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		want := pkg.ExpectFeatures[name]
+		f := features.find(name)
+		switch {
+		case f == nil:
+			problems = append(problems, fmt.Sprintf("%q wasn't mentioned", name))
+		case f.Enabled != want:
+			problems = append(problems, fmt.Sprintf("%q is %s", name, enabledWord(f.Enabled)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("configure didn't give the expected features: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func enabledWord(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// reportFeatures records the features configure found in the package's
+// result, and says which ones it disabled
+func (bu *build) reportFeatures(pkg *Package, features featureList, res *PackageResult) {
+	res.Features = features
+
+	var disabled []string
+	for _, f := range features {
+		if !f.Enabled {
+			disabled = append(disabled, f.Name)
+		}
+	}
+	bu.logger.Infof("configure found %d features for %s, %d of them disabled", len(features), pkg.Name, len(disabled))
+	if len(disabled) > 0 {
+		bu.logger.Infof("Disabled: %s", strings.Join(disabled, ", "))
+	}
+}
@@ -0,0 +1,154 @@
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFile is the name of the manifest Fetch writes next to the archives
+const ManifestFile = "manifest.json"
+
+// FetchOptions controls what Builder.Fetch downloads and where
+type FetchOptions struct {
+	// Dir is where archives and the manifest are written
+	Dir string
+	// Profiles, if set, select the profiles whose packages are
+	// considered, see Config.SelectProfiles
+	Profiles []string
+	// Packages, if set, restricts the fetch to these packages and their deps
+	Packages []string
+	// Download controls how archives are downloaded
+	Download DownloadOptions
+	// UpstreamFilenames names archives after their URL, see BuildOptions
+	UpstreamFilenames bool
+	// PlainJSON keeps the manifest uncompressed no matter how big it gets
+	PlainJSON bool
+}
+
+// Manifest lists the archives in a fetched source dir
+type Manifest struct {
+	Packages []*ManifestEntry
+}
+
+// ReadManifest reads the manifest Fetch wrote in dir, compressed or not
+func ReadManifest(dir string) (*Manifest, error) {
+	var manifest Manifest
+	err := readJSONFile(filepath.Join(dir, ManifestFile), &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+type ManifestEntry struct {
+	Name string
+	// Sources is the URL the package is configured with
+	Sources string
+	// URL is where the archive was actually downloaded from,
+	// after mirrors and redirects
+	URL string `json:",omitempty"`
+	// File is the archive's name, relative to the manifest
+	File     string
+	Checksum string
+	Size     int64
+	// BuildOnly is set for packages only needed to build others
+	BuildOnly bool `json:",omitempty"`
+}
+
+// Fetch downloads and verifies the archives of the selected packages into
+// opts.Dir without building anything, and writes a manifest there. The
+// resulting directory can later be used as BuildOptions.SourceDir.
+func (b *Builder) Fetch(ctx context.Context, opts FetchOptions) (*Manifest, error) {
+	packages := b.Config.Packages
+	if len(opts.Profiles) > 0 {
+		profiles, err := b.Config.SelectProfiles(opts.Profiles)
+		if err != nil {
+			return nil, err
+		}
+		packages = b.Config.PackagesForProfiles(profiles)
+	}
+	if len(opts.Packages) > 0 {
+		var err error
+		packages, err = resolveDeps(b.Config, opts.Packages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(opts.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("while creating fetch directory: %w", err)
+	}
+
+	bu, err := b.newBuild(ctx, BuildOptions{Download: opts.Download, UpstreamFilenames: opts.UpstreamFilenames}, newResult())
+	if err != nil {
+		return nil, err
+	}
+
+	buildOnly := b.Config.buildOnly()
+	manifest := &Manifest{}
+	for _, pkg := range packages {
+		bu.logger.Infof("Fetching %s", pkg.Name)
+
+		// extra sources are fetched as packages of their own, so that
+		// they can be found by name in the manifest later
+		all := []*Package{pkg}
+		for i := range pkg.ExtraSources {
+			all = append(all, pkg.extraPackage(i))
+		}
+
+		for _, p := range all {
+			entry, err := bu.fetchArchive(p, opts.Dir)
+			if err != nil {
+				return nil, fmt.Errorf("while fetching %s: %w", p.Name, err)
+			}
+			entry.BuildOnly = buildOnly[pkg.Name]
+			manifest.Packages = append(manifest.Packages, entry)
+		}
+	}
+
+	_, err = writeJSONFile(filepath.Join(opts.Dir, ManifestFile), manifest, opts.PlainJSON)
+	if err != nil {
+		return nil, fmt.Errorf("while writing manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// fetchArchive downloads pkg's archive into dir and describes it
+func (bu *build) fetchArchive(pkg *Package, dir string) (*ManifestEntry, error) {
+	format, err := formatForPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	file := bu.archiveName(pkg, format)
+	dest := filepath.Join(dir, file)
+
+	res := &PackageResult{Name: pkg.Name}
+	err = bu.fetchPackage(pkg, dest, res)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := computeChecksum(dest, "sha256")
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ManifestEntry{
+		Name:     pkg.Name,
+		Sources:  pkg.Sources,
+		URL:      res.URL,
+		File:     file,
+		Checksum: "sha256:" + digest,
+		Size:     stat.Size(),
+	}, nil
+}
@@ -0,0 +1,145 @@
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// fingerprintTools are the tools whose versions go in fingerprints, along
+// with the variable that picks another one
+var fingerprintTools = []struct{ name, variable string }{
+	{"cc", "CC"},
+	{"c++", "CXX"},
+	{"make", "MAKE"},
+	{"ld", "LD"},
+	{"ar", "AR"},
+	{"pkg-config", "PKG_CONFIG"},
+}
+
+// EnvFingerprint describes the environment a profile is built in, so
+// that a toolchain changing between builds doesn't go unnoticed
+type EnvFingerprint struct {
+	// Tools maps tools (cc, make...) to the first line of what their
+	// --version prints, or "not found"
+	Tools map[string]string
+	// Env has the variables that affect builds (CC, CFLAGS, LDFLAGS...)
+	// that are set, as the profile sees them
+	Env map[string]string
+}
+
+// fingerprint captures a profile's build environment: ours, with the
+// profile's UnsetEnv and Env applied
+func (bu *build) fingerprint(profile *Profile) *EnvFingerprint {
+	env := append([]string{}, profile.UnsetEnv...)
+	for k, v := range profile.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	fp := &EnvFingerprint{
+		Tools: make(map[string]string),
+		Env:   make(map[string]string),
+	}
+	for _, tool := range fingerprintTools {
+		exe := tool.name
+		// CC can be "gcc -m32" or "ccache gcc", the first word does it
+		if fields := strings.Fields(lookupEnv(env, tool.variable)); len(fields) > 0 {
+			exe = fields[0]
+		}
+		fp.Tools[tool.name] = bu.toolVersion(exe, env)
+	}
+	for _, key := range configCacheVars {
+		if v := lookupEnv(env, key); v != "" {
+			fp.Env[key] = v
+		}
+	}
+	return fp
+}
+
+// toolVersion returns the first line of what exe --version prints
+func (bu *build) toolVersion(exe string, env []string) string {
+	p, err := lookPath(exe, env)
+	if err != nil {
+		return "not found"
+	}
+
+	ctx, cancel := context.WithTimeout(bu.ctx, versionTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p, "--version")
+	cmd.Env = mergeEnv(os.Environ(), env)
+	// some tools exit non-zero after printing their version
+	out, _ := cmd.CombinedOutput()
+	line := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	if line == "" {
+		return p
+	}
+	return line
+}
+
+// changes lists what's different in other, like `make: "GNU Make 4.3"
+// is now "GNU Make 4.4"`
+func (fp *EnvFingerprint) changes(other *EnvFingerprint) []string {
+	var changes []string
+	compare := func(kind string, was map[string]string, is map[string]string) {
+		keys := make(map[string]bool)
+		for k := range was {
+			keys[k] = true
+		}
+		for k := range is {
+			keys[k] = true
+		}
+		var sorted []string
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			if was[k] != is[k] {
+				changes = append(changes, fmt.Sprintf("%s%s: %q is now %q", kind, k, was[k], is[k]))
+			}
+		}
+	}
+	compare("", fp.Tools, other.Tools)
+	compare("$", fp.Env, other.Env)
+	return changes
+}
+
+// checkFingerprint compares the profile's build environment with the
+// one recorded in its state the first time it was built. Changes are
+// warned about and recorded, unless EnforceEnvFingerprint is set, in
+// which case they fail the build.
+func (bu *build) checkFingerprint(profile *Profile) error {
+	fp := bu.fingerprint(profile)
+
+	bu.stateLock.Lock()
+	defer bu.stateLock.Unlock()
+	bu.result.Fingerprints[profile.Name] = fp
+
+	recorded := bu.state.Fingerprint
+	if recorded == nil {
+		bu.logger.Infof("Recording the build environment of profile %s", profile.Name)
+		bu.state.Fingerprint = fp
+		return nil
+	}
+
+	changes := recorded.changes(fp)
+	if len(changes) == 0 {
+		bu.logger.Debugf("Build environment of profile %s unchanged", profile.Name)
+		return nil
+	}
+	if bu.opts.EnforceEnvFingerprint {
+		return withCategory(FailureConfig, fmt.Errorf("the build environment of profile %s changed since it was recorded: %s",
+			profile.Name, strings.Join(changes, ", ")))
+	}
+
+	for _, change := range changes {
+		bu.logger.Warnf("Build environment of profile %s changed: %s", profile.Name, change)
+	}
+	bu.state.Fingerprint = fp
+	return nil
+}
@@ -0,0 +1,134 @@
+package ottolib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// BuildOrder returns packages sorted so that each one comes after
+// all of its deps, keeping config order otherwise
+func (c *Config) BuildOrder(packages []*Package) ([]*Package, error) {
+	var names []string
+	for _, pkg := range packages {
+		names = append(names, pkg.Name)
+	}
+	return resolveDeps(c, names)
+}
+
+// Cycles returns the groups of packages that depend on each other,
+// directly or not. Each group is sorted by name.
+func (c *Config) Cycles() [][]string {
+	// Tarjan's strongly connected components
+	index := 0
+	indices := make(map[string]int)
+	lowlinks := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var cycles [][]string
+
+	var strongConnect func(pkg *Package)
+	strongConnect = func(pkg *Package) {
+		indices[pkg.Name] = index
+		lowlinks[pkg.Name] = index
+		index++
+		stack = append(stack, pkg.Name)
+		onStack[pkg.Name] = true
+
+		selfLoop := false
+		for _, depName := range pkg.allDeps() {
+			if depName == pkg.Name {
+				selfLoop = true
+			}
+
+			dep := c.Package(depName)
+			if dep == nil {
+				continue
+			}
+
+			if _, visited := indices[depName]; !visited {
+				strongConnect(dep)
+				if lowlinks[depName] < lowlinks[pkg.Name] {
+					lowlinks[pkg.Name] = lowlinks[depName]
+				}
+			} else if onStack[depName] && indices[depName] < lowlinks[pkg.Name] {
+				lowlinks[pkg.Name] = indices[depName]
+			}
+		}
+
+		if lowlinks[pkg.Name] == indices[pkg.Name] {
+			var component []string
+			for {
+				name := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[name] = false
+				component = append(component, name)
+				if name == pkg.Name {
+					break
+				}
+			}
+
+			if len(component) > 1 || selfLoop {
+				sort.Strings(component)
+				cycles = append(cycles, component)
+			}
+		}
+	}
+
+	for _, pkg := range c.Packages {
+		if _, visited := indices[pkg.Name]; !visited {
+			strongConnect(pkg)
+		}
+	}
+
+	return cycles
+}
+
+// WriteGraph writes the dependency graph of packages to w in Graphviz DOT
+// format. Edges that are part of a cycle are drawn in red, deps that
+// aren't defined anywhere are drawn dashed, disabled packages in gray.
+func (c *Config) WriteGraph(w io.Writer, packages []*Package) error {
+	inCycle := make(map[string]int)
+	for i, cycle := range c.Cycles() {
+		for _, name := range cycle {
+			inCycle[name] = i + 1
+		}
+	}
+
+	fmt.Fprintf(w, "digraph otto {\n")
+	fmt.Fprintf(w, "  rankdir=LR;\n")
+	for _, pkg := range packages {
+		attrs := ""
+		if inCycle[pkg.Name] != 0 {
+			attrs = " [color=red]"
+		} else if !pkg.IsEnabled() {
+			attrs = fmt.Sprintf(" [color=gray,fontcolor=gray,label=%s]", dotQuote(pkg.Name+" (disabled)"))
+		}
+		fmt.Fprintf(w, "  %s%s;\n", dotQuote(pkg.Name), attrs)
+	}
+
+	for _, pkg := range packages {
+		for i, dep := range pkg.allDeps() {
+			attrs := ""
+			if c.Package(dep) == nil {
+				fmt.Fprintf(w, "  %s [style=dashed];\n", dotQuote(dep))
+				attrs = " [style=dashed]"
+			} else if inCycle[dep] != 0 && inCycle[dep] == inCycle[pkg.Name] {
+				attrs = " [color=red]"
+			} else if i >= len(pkg.Deps) {
+				// build deps
+				attrs = " [style=dotted]"
+			}
+			fmt.Fprintf(w, "  %s -> %s%s;\n", dotQuote(pkg.Name), dotQuote(dep), attrs)
+		}
+	}
+	_, err := fmt.Fprintf(w, "}\n")
+	return err
+}
+
+// dotQuote quotes s as a DOT ID. Unlike Go's %q, only quotes and
+// backslashes are escaped, DOT takes the rest as is.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
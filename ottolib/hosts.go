@@ -0,0 +1,115 @@
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+)
+
+// hostAllowed reports whether the host of rawURL matches one of
+// patterns (as in pins, so "*.example.org" works). Local (file://)
+// URLs don't have a host and are always allowed.
+func hostAllowed(patterns []string, rawURL string) (bool, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "file" {
+		return true, ""
+	}
+
+	host := u.Hostname()
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true, host
+		}
+	}
+	return false, host
+}
+
+// packageURLs returns every URL a package can be downloaded from,
+// extra sources included
+func packageURLs(pkg *Package) []string {
+	urls := append([]string{pkg.Sources}, pkg.Mirrors...)
+	for _, extra := range pkg.ExtraSources {
+		urls = append(urls, extra.URL)
+	}
+	return urls
+}
+
+// checkPackageHosts checks all of a package's URLs against patterns,
+// where word says what they come from
+func checkPackageHosts(pkg *Package, patterns []string, word string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	for _, u := range packageURLs(pkg) {
+		if ok, host := hostAllowed(patterns, u); !ok {
+			return withCategory(FailureConfig, fmt.Errorf("package %s: %s isn't in the %s", pkg.Name, host, word))
+		}
+	}
+	return nil
+}
+
+// checkHost fails if rawURL's host isn't allowed by the config's
+// AllowedHosts and those of the download options, when there are any.
+// It's called before every request, and for every redirect.
+func (bu *build) checkHost(rawURL string) error {
+	if len(bu.config.AllowedHosts) > 0 {
+		if ok, host := hostAllowed(bu.config.AllowedHosts, rawURL); !ok {
+			return withCategory(FailureConfig, fmt.Errorf("refusing to download from %s, it isn't in the config's allowed hosts", host))
+		}
+	}
+	if len(bu.opts.Download.AllowedHosts) > 0 {
+		if ok, host := hostAllowed(bu.opts.Download.AllowedHosts, rawURL); !ok {
+			return withCategory(FailureConfig, fmt.Errorf("refusing to download from %s, it isn't in --allowed-hosts", host))
+		}
+	}
+	return nil
+}
+
+// hostSlots limits how many downloads can be going on at once from any
+// one host, see Download.MaxPerHost. Downloads from different hosts
+// don't wait on each other.
+type hostSlots struct {
+	max int
+
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostSlots(max int) *hostSlots {
+	return &hostSlots{
+		max:   max,
+		slots: make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits for a slot for rawURL's host, and returns what gives it
+// back. It only fails if ctx is done first.
+func (hs *hostSlots) acquire(ctx context.Context, logger Logger, rawURL string) (func(), error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return func() {}, nil
+	}
+	host := u.Host
+
+	hs.lock.Lock()
+	slots, ok := hs.slots[host]
+	if !ok {
+		slots = make(chan struct{}, hs.max)
+		hs.slots[host] = slots
+	}
+	hs.lock.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		logger.Infof("Waiting for one of the %d downloads from %s to finish", hs.max, host)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
@@ -0,0 +1,103 @@
+package ottolib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// configLoader reads a config file and the ones it includes, see
+// Config.Include
+type configLoader struct {
+	// read returns the contents of a config file
+	read func(path string) ([]byte, error)
+
+	// loaded are the files read so far, so that a file included
+	// from several others is only merged in once
+	loaded map[string]bool
+	// definedIn is the file each profile and package is defined in,
+	// with keys like "package foo"
+	definedIn map[string]string
+}
+
+func newConfigLoader(read func(path string) ([]byte, error)) *configLoader {
+	return &configLoader{
+		read:      read,
+		loaded:    make(map[string]bool),
+		definedIn: make(map[string]string),
+	}
+}
+
+// load reads and parses the config at configPath, with the profiles and
+// packages of its includes (and theirs) before its own, in the order
+// they're listed. chain is the files that included it, to catch cycles.
+func (cl *configLoader) load(configPath string, chain []string) (*Config, error) {
+	configBytes, err := cl.read(configPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(configBytes, configPath)
+	if err != nil {
+		return nil, err
+	}
+	cl.loaded[configPath] = true
+	chain = append(append([]string{}, chain...), configPath)
+
+	var profiles []*Profile
+	var packages []*Package
+	for _, include := range config.Include {
+		p := include
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(configPath), p)
+		}
+		for _, q := range chain {
+			if q == p {
+				return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), p)
+			}
+		}
+		if cl.loaded[p] {
+			continue
+		}
+
+		included, err := cl.load(p, chain)
+		if err != nil {
+			return nil, fmt.Errorf("while including %s from %s: %w", include, configPath, err)
+		}
+		if len(included.Pins) > 0 || len(included.AllowedHosts) > 0 || len(included.Decompressors) > 0 {
+			return nil, fmt.Errorf("%s: only the top config can have Pins, AllowedHosts and Decompressors", p)
+		}
+		profiles = append(profiles, included.Profiles...)
+		packages = append(packages, included.Packages...)
+	}
+
+	for _, profile := range config.Profiles {
+		err = cl.define("profile", profile.Name, configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pkg := range config.Packages {
+		err = cl.define("package", pkg.Name, configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.Profiles = append(profiles, config.Profiles...)
+	config.Packages = append(packages, config.Packages...)
+	return config, nil
+}
+
+// define fails if a profile or package of that name is already defined
+// in another file. Duplicates within a file are left to validate.
+func (cl *configLoader) define(kind string, name string, configPath string) error {
+	if name == "" {
+		return nil
+	}
+	key := kind + " " + name
+	if other, ok := cl.definedIn[key]; ok && other != configPath {
+		return fmt.Errorf("%s %s is defined in both %s and %s", kind, name, other, configPath)
+	}
+	cl.definedIn[key] = configPath
+	return nil
+}
@@ -0,0 +1,79 @@
+package ottolib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// compressThreshold is the size above which JSON files otto writes
+// (manifests, state) get gzipped, unless plain JSON is asked for
+const compressThreshold = 1024 * 1024
+
+// writeJSONFile writes v as indented JSON to path, or gzipped to
+// path + ".gz" if it's big and plain is false. Whichever variant isn't
+// written is removed, so readers never see a stale one.
+func writeJSONFile(path string, v interface{}, plain bool) (string, error) {
+	payload, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	dest := path
+	stale := path + ".gz"
+	if !plain && len(payload) > compressThreshold {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err = zw.Write(payload)
+		if err != nil {
+			return "", err
+		}
+		err = zw.Close()
+		if err != nil {
+			return "", err
+		}
+
+		payload = buf.Bytes()
+		dest, stale = stale, dest
+	}
+
+	err = ioutil.WriteFile(dest, payload, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Remove(stale)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	return dest, nil
+}
+
+// readJSONFile reads JSON written by writeJSONFile into v,
+// decompressing it if needed
+func readJSONFile(path string, v interface{}) error {
+	payload, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		var f *os.File
+		f, err = os.Open(path + ".gz")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		payload, err = ioutil.ReadAll(zr)
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(payload, v)
+}
@@ -0,0 +1,89 @@
+package ottolib
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"text/template"
+)
+
+// The layouts otto uses when BuildOptions.SrcLayout and PrefixLayout
+// aren't set
+const (
+	DefaultSrcLayout    = "{{.OutDir}}/src/{{.Profile}}/{{.Package}}"
+	DefaultPrefixLayout = "{{.OutDir}}/{{.Profile}}"
+)
+
+// LayoutVars are what layout templates can use. Package is always empty
+// in prefix layouts.
+type LayoutVars struct {
+	OutDir  string
+	Profile string
+	Package string
+}
+
+// layout is where package sources and prefixes go in the outdir
+type layout struct {
+	src    *template.Template
+	prefix *template.Template
+}
+
+// newLayout parses the layouts in opts, and makes sure no two packages
+// would end up sharing a source directory
+func newLayout(opts BuildOptions) (*layout, error) {
+	srcLayout, prefixLayout := opts.SrcLayout, opts.PrefixLayout
+	if srcLayout == "" {
+		srcLayout = DefaultSrcLayout
+	}
+	if prefixLayout == "" {
+		prefixLayout = DefaultPrefixLayout
+	}
+
+	var l layout
+	var err error
+	l.src, err = template.New("src layout").Parse(srcLayout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid src layout: %w", err)
+	}
+	l.prefix, err = template.New("prefix layout").Parse(prefixLayout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix layout: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, vars := range []LayoutVars{{"/out", "a", "x"}, {"/out", "a", "y"}, {"/out", "b", "x"}} {
+		dir, err := l.expand(l.src, vars)
+		if err != nil {
+			return nil, err
+		}
+		if seen[dir] {
+			return nil, fmt.Errorf("src layout %s has to use both {{.Profile}} and {{.Package}}, or packages would share source directories", srcLayout)
+		}
+		seen[dir] = true
+	}
+	_, err = l.expand(l.prefix, LayoutVars{OutDir: "/out", Profile: "a"})
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// expand evaluates a layout template into an absolute path
+func (l *layout) expand(t *template.Template, vars LayoutVars) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, vars)
+	if err != nil {
+		return "", fmt.Errorf("while expanding %s: %w", t.Name(), err)
+	}
+	return filepath.Abs(buf.String())
+}
+
+// pkgSrcDir returns where a package's archive goes and gets extracted,
+// for a profile
+func (bu *build) pkgSrcDir(profileName string, pkgName string) (string, error) {
+	return bu.layout.expand(bu.layout.src, LayoutVars{
+		OutDir:  bu.opts.OutDir,
+		Profile: profileName,
+		Package: pkgName,
+	})
+}
@@ -0,0 +1,83 @@
+package ottolib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// packageLimits are what a package's build commands are limited to,
+// see Package.Timeout, MaxMemory and MaxProcesses
+type packageLimits struct {
+	timeout      time.Duration
+	maxMemory    uint64
+	maxProcesses int
+
+	// ctx expires after timeout, it's set by buildPackage
+	ctx context.Context
+}
+
+// limits parses the package's limits, or returns nil if it has none
+func (p *Package) limits() (*packageLimits, error) {
+	if p.Timeout == "" && p.MaxMemory == "" && p.MaxProcesses == 0 {
+		return nil, nil
+	}
+
+	l := &packageLimits{maxProcesses: p.MaxProcesses}
+	if p.Timeout != "" {
+		timeout, err := time.ParseDuration(p.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("package %s: invalid timeout %s, expected a duration like 30m", p.Name, p.Timeout)
+		}
+		l.timeout = timeout
+	}
+	if p.MaxMemory != "" {
+		maxMemory, err := humanize.ParseBytes(p.MaxMemory)
+		if err != nil || maxMemory == 0 {
+			return nil, fmt.Errorf("package %s: invalid max memory %s, expected a size like 4GB", p.Name, p.MaxMemory)
+		}
+		l.maxMemory = maxMemory
+	}
+	if p.MaxProcesses < 0 {
+		return nil, fmt.Errorf("package %s: invalid max processes %d", p.Name, p.MaxProcesses)
+	}
+	return l, nil
+}
+
+// command returns an exec.Cmd that runs exe and args within the
+// limits. With a timeout, it gets a process group of its own, so that
+// everything it started is killed with it.
+func (l *packageLimits) command(ctx context.Context, exe string, args []string) (*exec.Cmd, error) {
+	if l.maxMemory > 0 || l.maxProcesses > 0 {
+		var err error
+		exe, args, err = limitCommand(l, exe, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, exe, args...)
+	if l.timeout > 0 {
+		killGroup(cmd)
+	}
+	return cmd, nil
+}
+
+// explain makes the error of a command run within the limits say
+// when they're what made it fail
+func (l *packageLimits) explain(err error) error {
+	if err == nil {
+		return nil
+	}
+	if l.ctx != nil && errors.Is(l.ctx.Err(), context.DeadlineExceeded) {
+		return withCategory(FailureTimeout, fmt.Errorf("killed after %s, the package's timeout", l.timeout))
+	}
+	if l.maxMemory > 0 || l.maxProcesses > 0 {
+		return fmt.Errorf("%w (the package's MaxMemory or MaxProcesses may be why)", err)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package ottolib
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// killGroup makes cmd the leader of a new process group, and has the
+// whole group killed when cmd's context is done. Since Ctrl-C no longer
+// reaches the group, it also gets killed if otto dies.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// limitCommand returns exe and args wrapped in a shell that sets l's
+// resource limits, with ulimit, before running them, so that they apply
+// from the very start. MaxMemory limits each process's address space,
+// and MaxProcesses is RLIMIT_NPROC: it counts all the processes of the
+// user, not just the package's.
+func limitCommand(l *packageLimits, exe string, args []string) (string, []string, error) {
+	script := ""
+	if l.maxMemory > 0 {
+		// in kilobytes
+		script += fmt.Sprintf("ulimit -v %d && ", l.maxMemory/1024)
+	}
+	if l.maxProcesses > 0 {
+		// -u in bash, -p in dash
+		script += fmt.Sprintf("{ ulimit -u %d 2>/dev/null || ulimit -p %d; } && ", l.maxProcesses, l.maxProcesses)
+	}
+	script += `exec "$@"`
+
+	return "/bin/sh", append([]string{"-c", script, "otto-limits", exe}, args...), nil
+}
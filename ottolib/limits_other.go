@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package ottolib
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// killGroup does nothing outside of Linux, only cmd itself is killed
+// when its context is done
+func killGroup(cmd *exec.Cmd) {}
+
+// limitCommand isn't supported outside of Linux
+func limitCommand(l *packageLimits, exe string, args []string) (string, []string, error) {
+	return "", nil, fmt.Errorf("MaxMemory and MaxProcesses are only supported on Linux")
+}
@@ -0,0 +1,130 @@
+package ottolib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mergeConfigure returns the configure args a package gets in a profile,
+// in the order they're passed, minus blacklisted ones, along with where
+// each one came from (like "profile x's Configure"). Conditional args
+// are only there if pass says so. otto's own args aren't included.
+func mergeConfigure(profile *Profile, pkg *Package, pass func(*ConditionalArg) bool) ([]string, []string) {
+	var args, origins []string
+	add := func(origin string, newArgs ...string) {
+		for _, arg := range newArgs {
+			args = append(args, arg)
+			origins = append(origins, origin)
+		}
+	}
+
+	// ConfigurePrepend and ConfigureAppend let packages put flags before
+	// or after the profile's, since with configure the last flag wins
+	add(fmt.Sprintf("package %s's ConfigurePrepend", pkg.Name), pkg.ConfigurePrepend...)
+
+	configureBlacklist := &Blacklist{Prefixes: pkg.ConfigureBlacklist}
+
+	for _, arg := range profile.Configure {
+		if !configureBlacklist.Has(arg) {
+			add(fmt.Sprintf("profile %s's Configure", profile.Name), arg)
+		}
+	}
+
+	for _, arg := range pkg.Configure {
+		if !configureBlacklist.Has(arg) {
+			add(fmt.Sprintf("package %s's Configure", pkg.Name), arg)
+		}
+	}
+
+	for _, cond := range pkg.ConditionalConfigure {
+		if !pass(cond) {
+			continue
+		}
+		if !configureBlacklist.Has(cond.Arg) {
+			add(fmt.Sprintf("package %s's ConditionalConfigure", pkg.Name), cond.Arg)
+		}
+	}
+
+	add(fmt.Sprintf("package %s's ConfigureAppend", pkg.Name), pkg.ConfigureAppend...)
+
+	return args, origins
+}
+
+// configureFlag splits a configure arg into the option it sets and the
+// value it sets it to, as far as contradictions go: --disable-x is
+// --enable-x set to "no", --with-x is --with-x set to "yes", and so on
+func configureFlag(arg string) (string, string) {
+	name, value := arg, ""
+	hasValue := false
+	if i := strings.Index(arg, "="); i >= 0 {
+		name, value, hasValue = arg[:i], arg[i+1:], true
+	}
+
+	switch {
+	case strings.HasPrefix(name, "--disable-") && !hasValue:
+		return "--enable-" + strings.TrimPrefix(name, "--disable-"), "no"
+	case strings.HasPrefix(name, "--without-") && !hasValue:
+		return "--with-" + strings.TrimPrefix(name, "--without-"), "no"
+	case (strings.HasPrefix(name, "--enable-") || strings.HasPrefix(name, "--with-")) && !hasValue:
+		return name, "yes"
+	}
+	return name, value
+}
+
+// argOwner is who an arg comes from, going by its origin: "otto", "profile"
+// or "package"
+func argOwner(origin string) string {
+	return strings.SplitN(origin, " ", 2)[0]
+}
+
+// LintConfigure looks for configure args that contradict each other
+// (--enable-x and --disable-x, or --host given two different values) or
+// are passed twice, in every package's args for every profile it's
+// built for, and returns a warning for each. Packages overriding their
+// profile's args is what ConfigureAppend is for, so the package's args
+// contradicting the profile's isn't warned about, contradicting otto's
+// own --prefix is.
+func (c *Config) LintConfigure() []string {
+	var warnings []string
+	seen := make(map[string]bool)
+	warn := func(format string, args ...interface{}) {
+		w := fmt.Sprintf(format, args...)
+		if !seen[w] {
+			seen[w] = true
+			warnings = append(warnings, w)
+		}
+	}
+
+	for _, profile := range c.Profiles {
+		for _, pkg := range c.PackagesFor(profile) {
+			var args, origins []string
+			if pkg.PrefixStyle == "" || pkg.PrefixStyle == PrefixStyleConfigure {
+				args, origins = []string{"--prefix=$PREFIX"}, []string{"otto"}
+			}
+			merged, mergedOrigins := mergeConfigure(profile, pkg, func(*ConditionalArg) bool { return true })
+			args = append(args, merged...)
+			origins = append(origins, mergedOrigins...)
+
+			for i, arg := range args {
+				name, value := configureFlag(arg)
+				for j := 0; j < i; j++ {
+					if args[j] == arg {
+						warn("package %s: %s is passed twice (from %s and %s)", pkg.Name, arg, origins[j], origins[i])
+						break
+					}
+
+					earlierName, earlierValue := configureFlag(args[j])
+					if earlierName != name || earlierValue == value {
+						continue
+					}
+					owners := argOwner(origins[j]) + " " + argOwner(origins[i])
+					if owners == "profile package" || owners == "package profile" {
+						continue
+					}
+					warn("package %s: %s (from %s) contradicts %s (from %s)", pkg.Name, arg, origins[i], args[j], origins[j])
+				}
+			}
+		}
+	}
+	return warnings
+}
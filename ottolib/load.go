@@ -0,0 +1,59 @@
+package ottolib
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadPollInterval is how often the load average is checked while
+// waiting for it to go down
+const loadPollInterval = 5 * time.Second
+
+// loadAverage returns the 1-minute load average, and false when it
+// can't be read (anywhere but Linux, for now)
+func loadAverage() (float64, bool) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
+
+// waitForLoad blocks while the load average is above MaxLoad, like
+// make -l, so that otto doesn't hog a shared machine
+func (bu *build) waitForLoad() error {
+	if bu.opts.MaxLoad <= 0 {
+		return nil
+	}
+
+	warned := false
+	for {
+		load, ok := loadAverage()
+		if !ok || load <= bu.opts.MaxLoad {
+			return nil
+		}
+
+		if !warned {
+			bu.logger.Infof("Load average is %.2f, waiting for it to go below %.2f", load, bu.opts.MaxLoad)
+			warned = true
+		}
+
+		select {
+		case <-bu.ctx.Done():
+			return bu.ctx.Err()
+		case <-time.After(loadPollInterval):
+		}
+	}
+}
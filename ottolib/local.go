@@ -0,0 +1,101 @@
+package ottolib
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// FormatDir is the format of packages whose sources are a local
+// directory (a file:// URL), which is copied instead of extracted
+const FormatDir = "dir"
+
+// localPath returns the path a file:// URL points to
+func localPath(sources string) (string, bool) {
+	u, err := url.Parse(sources)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// isLocalDir reports whether a package's sources are a local directory
+func isLocalDir(pkg *Package) bool {
+	p, ok := localPath(pkg.Sources)
+	if !ok {
+		return false
+	}
+	stats, err := os.Stat(p)
+	return err == nil && stats.IsDir()
+}
+
+// fetchLocal is what fetchPackage does for file:// URLs: archives are
+// linked (or copied) to dest and verified, directories are left where
+// they are until extraction
+func (bu *build) fetchLocal(pkg *Package, p string, dest string) error {
+	stats, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("local sources for %s: %w", pkg.Name, err)
+	}
+	if stats.IsDir() {
+		return nil
+	}
+
+	err = bu.verifyChecksum(p, pkg.Checksum)
+	if err != nil {
+		return err
+	}
+
+	bu.logger.Infof("Using local archive %s", p)
+	return linkOrCopy(p, dest)
+}
+
+// copyLocalDir copies the contents of a local source directory into
+// dest. The copy is made afresh every time, so that files removed from
+// the original don't linger, and it's a real copy: builds like writing
+// in their source tree, and that one's someone's checkout.
+func (bu *build) copyLocalDir(dir string, dest string) error {
+	bu.logger.Infof("Copying %s...", dir)
+
+	err := os.RemoveAll(dest)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			err := copyFile(p, target)
+			if err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode())
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("while copying %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package ottolib
+
+import "os"
+
+// lockFile just opens the file at path, there's no flock on Windows,
+// so processes sharing a cache dir there can race
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+}
@@ -0,0 +1,158 @@
+package ottolib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Logger is what otto reports progress to. Implement it to
+// capture or redirect otto's output when embedding it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogFlags are the flags otto's loggers pass to the standard log
+// package: dates, and times with microseconds, so that the order of
+// things happening in parallel can be told
+const LogFlags = log.LstdFlags | log.Lmicroseconds
+
+const (
+	colorReset  = "\x1b[0m"
+	colorFaint  = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+)
+
+type stdLogger struct {
+	l     *log.Logger
+	color bool
+}
+
+// NewLogger returns a Logger that writes lines timestamped to the
+// microsecond to w. It's safe to use from several goroutines, lines are
+// written whole. Levels are colored if w is a terminal, see ColorEnabled.
+func NewLogger(w io.Writer) Logger {
+	return NewColorLogger(w, ColorEnabled(w))
+}
+
+// NewColorLogger is like NewLogger, but colors levels or not as told
+func NewColorLogger(w io.Writer, color bool) Logger {
+	return &stdLogger{
+		l:     log.New(w, "", LogFlags),
+		color: color,
+	}
+}
+
+// DiscardLogger returns a Logger that drops everything
+func DiscardLogger() Logger {
+	return NewColorLogger(ioutil.Discard, false)
+}
+
+// MultiLogger returns a Logger that logs everything to each of loggers,
+// e.g. to the console and to a file
+func MultiLogger(loggers ...Logger) Logger {
+	return multiLogger(loggers)
+}
+
+type multiLogger []Logger
+
+func (ml multiLogger) Debugf(format string, args ...interface{}) {
+	for _, l := range ml {
+		l.Debugf(format, args...)
+	}
+}
+
+func (ml multiLogger) Infof(format string, args ...interface{}) {
+	for _, l := range ml {
+		l.Infof(format, args...)
+	}
+}
+
+func (ml multiLogger) Warnf(format string, args ...interface{}) {
+	for _, l := range ml {
+		l.Warnf(format, args...)
+	}
+}
+
+func (ml multiLogger) Errorf(format string, args ...interface{}) {
+	for _, l := range ml {
+		l.Errorf(format, args...)
+	}
+}
+
+// withPrefix returns a Logger that puts prefix in front of every
+// message before logging it to l
+func withPrefix(l Logger, prefix string) Logger {
+	return &prefixLogger{l: l, prefix: prefix}
+}
+
+type prefixLogger struct {
+	l      Logger
+	prefix string
+}
+
+func (pl *prefixLogger) Debugf(format string, args ...interface{}) {
+	pl.l.Debugf("%s", pl.prefix+fmt.Sprintf(format, args...))
+}
+
+func (pl *prefixLogger) Infof(format string, args ...interface{}) {
+	pl.l.Infof("%s", pl.prefix+fmt.Sprintf(format, args...))
+}
+
+func (pl *prefixLogger) Warnf(format string, args ...interface{}) {
+	pl.l.Warnf("%s", pl.prefix+fmt.Sprintf(format, args...))
+}
+
+func (pl *prefixLogger) Errorf(format string, args ...interface{}) {
+	pl.l.Errorf("%s", pl.prefix+fmt.Sprintf(format, args...))
+}
+
+// ColorEnabled reports whether output to w should be colored: only if
+// it's a terminal, and NO_COLOR isn't set (see https://no-color.org).
+// CI logs are usually captured through a pipe, so they stay plain.
+func ColorEnabled(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+func (sl *stdLogger) output(color string, prefix string, format string, args ...interface{}) {
+	msg := prefix + fmt.Sprintf(format, args...)
+	if sl.color && color != "" {
+		msg = color + msg + colorReset
+	}
+	sl.l.Output(3, msg)
+}
+
+func (sl *stdLogger) Debugf(format string, args ...interface{}) {
+	sl.output(colorFaint, "", format, args...)
+}
+
+func (sl *stdLogger) Infof(format string, args ...interface{}) {
+	sl.output("", "", format, args...)
+}
+
+func (sl *stdLogger) Warnf(format string, args ...interface{}) {
+	sl.output(colorYellow, "Warning: ", format, args...)
+}
+
+func (sl *stdLogger) Errorf(format string, args ...interface{}) {
+	sl.output(colorRed, "Error: ", format, args...)
+}
@@ -0,0 +1,76 @@
+package ottolib
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// packagePrefix is where pkg gets installed with PrefixPerPackage
+func packagePrefix(prefix string, pkg *Package) string {
+	return filepath.Join(prefix, "pkgs", pkg.Name)
+}
+
+// mergePrefixes unions the prefixes of the given packages (as given
+// by prefixOf) into merged, in order, so that later packages win.
+// Files are hardlinked when possible.
+func (bu *build) mergePrefixes(merged string, decisions []*Decision, prefixOf func(*Package) string) error {
+	bu.logger.Infof("Merging package prefixes into %s", merged)
+
+	owners := make(map[string]string)
+	for _, d := range decisions {
+		pkgPrefix := prefixOf(d.Package)
+		if pkgPrefix == "" {
+			continue
+		}
+		if _, err := os.Stat(pkgPrefix); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.Walk(pkgPrefix, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(pkgPrefix, p)
+			if err != nil {
+				return err
+			}
+			dest := filepath.Join(merged, rel)
+
+			switch {
+			case info.IsDir():
+				return os.MkdirAll(dest, 0755)
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				os.Remove(dest)
+				err = os.Symlink(target, dest)
+				if err != nil {
+					return err
+				}
+			default:
+				err := linkOrCopy(p, dest)
+				if err != nil {
+					return err
+				}
+				err = os.Chmod(dest, info.Mode())
+				if err != nil {
+					return err
+				}
+			}
+
+			if owner, ok := owners[rel]; ok {
+				bu.logger.Warnf("%s from %s overwrites the one from %s", rel, d.Package.Name, owner)
+			}
+			owners[rel] = d.Package.Name
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package ottolib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsWriter writes metrics in the Prometheus text format
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// metric writes the HELP and TYPE lines of a metric
+func (mw *metricsWriter) metric(name string, kind string, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value of a metric, with labels given as name, value,
+// name, value...
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabel(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name = name + "{" + strings.Join(pairs, ",") + "}"
+	}
+	mw.printf("%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteMetrics writes metrics about the build to w, in the Prometheus
+// text format node_exporter's textfile collector reads. buildErr is the
+// error Build returned, if any.
+func (r *Result) WriteMetrics(w io.Writer, buildErr error) error {
+	mw := &metricsWriter{w: w}
+
+	mw.metric("otto_build_success", "gauge", "Whether the last build succeeded")
+	mw.sample("otto_build_success", boolValue(buildErr == nil))
+	mw.metric("otto_build_timestamp_seconds", "gauge", "When the last build started")
+	mw.sample("otto_build_timestamp_seconds", float64(r.StartTime.Unix()))
+	mw.metric("otto_build_duration_seconds", "gauge", "How long the last build took")
+	mw.sample("otto_build_duration_seconds", r.Duration.Seconds())
+	mw.metric("otto_build_exit_code", "gauge", "The exit code of the last build, see the failure categories")
+	mw.sample("otto_build_exit_code", float64(ExitCode(r.FailureCategory(buildErr))))
+
+	mw.metric("otto_packages", "gauge", "How many packages ended up in each status")
+	for _, status := range []Status{StatusSucceeded, StatusFailed, StatusSkipped, StatusPending} {
+		mw.sample("otto_packages", float64(r.Count(status)), "status", string(status))
+	}
+
+	mw.metric("otto_downloaded_bytes", "gauge", "How much was downloaded")
+	mw.sample("otto_downloaded_bytes", float64(r.BytesDownloaded()))
+
+	var fetched, hits int
+	for _, pr := range r.Results {
+		// local sources aren't fetched
+		if pr.CacheHit || pr.URL != "" {
+			fetched++
+			if pr.CacheHit {
+				hits++
+			}
+		}
+	}
+	mw.metric("otto_archive_cache_hit_ratio", "gauge", "The share of archives that didn't have to be downloaded")
+	if fetched > 0 {
+		mw.sample("otto_archive_cache_hit_ratio", float64(hits)/float64(fetched))
+	} else {
+		mw.sample("otto_archive_cache_hit_ratio", 0)
+	}
+
+	// only packages that were attempted can tell anything
+	var attempted []*PackageResult
+	for _, pr := range r.Results {
+		if pr.Status == StatusSucceeded || pr.Status == StatusFailed {
+			attempted = append(attempted, pr)
+		}
+	}
+
+	mw.metric("otto_package_success", "gauge", "Whether the package built")
+	for _, pr := range attempted {
+		mw.sample("otto_package_success", boolValue(pr.Status == StatusSucceeded), "profile", pr.Profile, "package", pr.Name)
+	}
+	mw.metric("otto_package_duration_seconds", "gauge", "How long the package took to download and build")
+	for _, pr := range attempted {
+		mw.sample("otto_package_duration_seconds", pr.Duration.Seconds(), "profile", pr.Profile, "package", pr.Name)
+	}
+	mw.metric("otto_package_downloaded_bytes", "gauge", "How much was downloaded for the package")
+	for _, pr := range attempted {
+		mw.sample("otto_package_downloaded_bytes", float64(pr.BytesDownloaded), "profile", pr.Profile, "package", pr.Name)
+	}
+	mw.metric("otto_package_retries", "gauge", "How many times the package was built again, see Retries")
+	for _, pr := range attempted {
+		mw.sample("otto_package_retries", float64(pr.Retries), "profile", pr.Profile, "package", pr.Name)
+	}
+
+	return mw.err
+}
+
+// metricsPushTimeout is how long pushing metrics can take
+const metricsPushTimeout = 30 * time.Second
+
+// PushMetrics sends the build's metrics (see WriteMetrics) to the
+// Prometheus Pushgateway at gateway, like "http://pushgateway:9091",
+// under the job "otto". They replace that job's previous metrics.
+func (r *Result) PushMetrics(gateway string, buildErr error) error {
+	var buf bytes.Buffer
+	err := r.WriteMetrics(&buf, buildErr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), metricsPushTimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(gateway, "/") + "/metrics/job/otto"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
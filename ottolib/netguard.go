@@ -0,0 +1,106 @@
+package ottolib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// proxyVars are the variables that make just about everything (curl,
+// wget, git, pip, go...) go through a proxy
+var proxyVars = []string{"http_proxy", "https_proxy", "ftp_proxy", "all_proxy", "HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "ALL_PROXY"}
+
+// netGuard is a proxy on localhost that refuses every request, and
+// remembers them. With AssertNoNetwork, packages are built with every
+// proxy variable pointing to one of their own, so that what their
+// build tries to download is known and blamed on the right package,
+// even with others being extracted meanwhile.
+type netGuard struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	attempts []string
+}
+
+func startNetGuard() (*netGuard, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("while starting the network guard: %w", err)
+	}
+
+	ng := &netGuard{listener: listener}
+	go http.Serve(listener, ng)
+	return ng, nil
+}
+
+func (ng *netGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		// https, the URL stays between the client and the server
+		target = r.Host
+	}
+
+	ng.lock.Lock()
+	ng.attempts = append(ng.attempts, r.Method+" "+target)
+	ng.lock.Unlock()
+
+	http.Error(w, "otto: no network access allowed during builds (--assert-no-network)", http.StatusForbidden)
+}
+
+// env points every proxy variable to the guard, and makes sure no host
+// bypasses it
+func (ng *netGuard) env() []string {
+	proxy := "http://" + ng.listener.Addr().String()
+	var env []string
+	for _, key := range proxyVars {
+		env = append(env, key+"="+proxy)
+	}
+	return append(env, "no_proxy=", "NO_PROXY=")
+}
+
+// stop shuts the guard down and returns the requests it got
+func (ng *netGuard) stop() []string {
+	ng.listener.Close()
+
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	return ng.attempts
+}
+
+// withoutNetwork runs build, which configures, builds and installs pkg,
+// behind a netGuard if AssertNoNetwork is set. Any request the build
+// makes through it fails the package (in a "network check" phase), even
+// if the build itself succeeded. Downloads otto does itself aren't
+// affected.
+func (bu *build) withoutNetwork(pkg *Package, prep *prepared, res *PackageResult, build func(prep *prepared) error) error {
+	if !bu.opts.AssertNoNetwork {
+		return build(prep)
+	}
+
+	ng, err := startNetGuard()
+	if err != nil {
+		return err
+	}
+	guarded := *prep
+	guarded.env = append(append([]string{}, prep.env...), ng.env()...)
+
+	err = build(&guarded)
+	attempts := ng.stop()
+	if len(attempts) == 0 {
+		return err
+	}
+
+	return res.phase("network check", func() error {
+		for _, attempt := range attempts {
+			bu.logger.Errorf("%s tried to access the network: %s", pkg.Name, attempt)
+		}
+		shown := attempts
+		if len(shown) > 3 {
+			shown = append(shown[:3:3], "...")
+		}
+		return withCategory(FailureConfig, fmt.Errorf("%s made %d network requests while building, which --assert-no-network forbids: %s",
+			pkg.Name, len(attempts), strings.Join(shown, ", ")))
+	})
+}
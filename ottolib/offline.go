@@ -0,0 +1,67 @@
+package ottolib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkOffline makes sure every archive the jobs need is already where
+// an earlier build downloaded it (or in the cache dir), so that an
+// offline build fails before starting rather than halfway through
+func (bu *build) checkOffline(profile *Profile, jobs []*prepareJob) error {
+	if !bu.opts.Offline || bu.opts.SourceDir != "" {
+		return nil
+	}
+
+	var missing []string
+	for _, job := range jobs {
+		all := []*Package{job.pkg}
+		for i := range job.pkg.ExtraSources {
+			all = append(all, job.pkg.extraPackage(i))
+		}
+
+		for _, p := range all {
+			if _, ok := localPath(p.Sources); ok {
+				continue
+			}
+
+			format, err := formatForPackage(p)
+			if err != nil {
+				return err
+			}
+
+			if cacheDir := bu.opts.Download.CacheDir; cacheDir != "" {
+				if _, err := os.Stat(filepath.Join(cacheDir, cacheKey(p))); err == nil {
+					continue
+				}
+			}
+
+			pkgSrc, err := bu.pkgSrcDir(profile.Name, job.pkg.Name)
+			if err != nil {
+				return err
+			}
+			archive := filepath.Join(pkgSrc, bu.archiveName(p, format))
+			if _, err := os.Stat(archive); err != nil {
+				missing = append(missing, fmt.Sprintf("%s (%s)", p.Name, archive))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("offline, and %d archives would need downloading:\n  %s", len(missing), strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// useCached is what fetchPackage does offline: use the archive from an
+// earlier build, as long as it still checks out
+func (bu *build) useCached(pkg *Package, dest string) error {
+	if _, err := os.Stat(dest); err != nil {
+		return fmt.Errorf("offline, and %s isn't cached at %s", pkg.Name, dest)
+	}
+
+	bu.logger.Infof("Offline, using cached %s", dest)
+	return bu.verifyChecksum(dest, pkg.Checksum)
+}
@@ -0,0 +1,84 @@
+package ottolib
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// lineWriter prefixes every line written to it before passing it on to
+// w, a whole line at a time, so that the output of commands running at
+// the same time doesn't get mixed up mid-line. lock is held for every
+// write to w, and shared by all the lineWriters writing to the console.
+type lineWriter struct {
+	w      io.Writer
+	lock   *sync.Mutex
+	prefix []byte
+	buf    []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+
+	i := bytes.LastIndexByte(lw.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	err := lw.write(lw.buf[:i+1])
+	lw.buf = append(lw.buf[:0], lw.buf[i+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes out what's left of the last line, if it didn't end
+// with a newline
+func (lw *lineWriter) flush() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	err := lw.write(append(lw.buf, '\n'))
+	lw.buf = lw.buf[:0]
+	return err
+}
+
+func (lw *lineWriter) write(lines []byte) error {
+	var out []byte
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		out = append(out, lw.prefix...)
+		out = append(out, line...)
+	}
+
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	_, err := lw.w.Write(out)
+	return err
+}
+
+// outputLabel returns the [profile/package] prefix for the output of a
+// command run in dir. Commands always run somewhere within a package's
+// source directory (see SrcLayout), so that's what it's taken from.
+func (bu *build) outputLabel(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	for _, pr := range bu.result.Results {
+		pkgSrc, err := bu.pkgSrcDir(pr.Profile, pr.Name)
+		if err != nil {
+			continue
+		}
+		if abs == pkgSrc || strings.HasPrefix(abs, pkgSrc+string(filepath.Separator)) {
+			return "[" + pr.Profile + "/" + pr.Name + "] "
+		}
+	}
+	return ""
+}
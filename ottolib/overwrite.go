@@ -0,0 +1,100 @@
+package ottolib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileStamp is what tells whether a file in the prefix was (re)written
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// snapshotPrefix stamps every file in prefix, by path relative to it
+func snapshotPrefix(prefix string) (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	err := filepath.Walk(prefix, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == prefix {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(prefix, p)
+		if err != nil {
+			return err
+		}
+		stamps[rel] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("while looking at what's in %s: %w", prefix, err)
+	}
+	return stamps, nil
+}
+
+// watchOverwrites runs install, which installs pkg into prefix, then
+// finds the files it wrote that other packages had installed, in an
+// "overwrites" phase. The state remembers which package installed what,
+// across runs. Overwrites are warned about, or fail the package with
+// StrictOverwrites.
+//
+// With a prefix per package (or the store), packages can't overwrite
+// each other, and install is just run.
+func (bu *build) watchOverwrites(pkg *Package, prefix string, res *PackageResult, install func() error) error {
+	if bu.opts.PrefixPerPackage || bu.opts.StoreDir != "" {
+		return install()
+	}
+
+	before, err := snapshotPrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	err = install()
+	if err != nil {
+		return err
+	}
+
+	return res.phase("overwrites", func() error {
+		after, err := snapshotPrefix(prefix)
+		if err != nil {
+			return err
+		}
+
+		bu.stateLock.Lock()
+		var conflicts []string
+		for rel, stamp := range after {
+			if old, ok := before[rel]; ok && old == stamp {
+				continue
+			}
+			if owner := bu.state.Owners[rel]; owner != "" && owner != pkg.Name {
+				conflicts = append(conflicts, fmt.Sprintf("%s (installed by %s)", rel, owner))
+			}
+			bu.state.Owners[rel] = pkg.Name
+		}
+		bu.stateLock.Unlock()
+
+		if len(conflicts) == 0 {
+			return nil
+		}
+
+		sort.Strings(conflicts)
+		if bu.opts.StrictOverwrites {
+			return fmt.Errorf("%s overwrote files other packages installed: %s", pkg.Name, strings.Join(conflicts, ", "))
+		}
+		for _, c := range conflicts {
+			bu.logger.Warnf("%s overwrote %s", pkg.Name, c)
+		}
+		return nil
+	})
+}
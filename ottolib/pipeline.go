@@ -0,0 +1,113 @@
+package ottolib
+
+import (
+	"fmt"
+	"sync"
+)
+
+type prepareJob struct {
+	pkg *Package
+	res *PackageResult
+	// prefix is where pkg gets installed, and inherited the
+	// prefixes of earlier packages, see PrefixPerPackage
+	prefix    string
+	inherited []string
+
+	prep *prepared
+	err  error
+	done chan struct{}
+}
+
+// pipeline prepares (downloads and extracts) packages ahead of
+// them being built, on up to ExtractJobs goroutines
+type pipeline struct {
+	bu      *build
+	jobs    []*prepareJob
+	prepare func(wb *build, job *prepareJob) (*prepared, error)
+
+	// inline is set when there's no background work, and
+	// packages are prepared as they're waited on
+	inline bool
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// startPipeline starts preparing jobs. prepare is given the build to
+// prepare them with: bu itself, or a worker() of it.
+func (bu *build) startPipeline(jobs []*prepareJob, prepare func(wb *build, job *prepareJob) (*prepared, error)) *pipeline {
+	p := &pipeline{
+		bu:      bu,
+		jobs:    jobs,
+		prepare: prepare,
+		inline:  bu.opts.ExtractJobs <= 0,
+		stopped: make(chan struct{}),
+	}
+
+	for _, job := range jobs {
+		job.done = make(chan struct{})
+	}
+
+	if p.inline {
+		return p
+	}
+
+	// jobs are handed out in build order, so that the first
+	// package to be built is also the first to be ready
+	queue := make(chan *prepareJob)
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-p.stopped:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < bu.opts.ExtractJobs; i++ {
+		wb := bu.worker(i + 1)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range queue {
+				job.prep, job.err = p.prepare(wb, job)
+				close(job.done)
+			}
+		}()
+	}
+
+	return p
+}
+
+// wait returns the prepared package for the i-th job, blocking
+// until it's ready
+func (p *pipeline) wait(i int) (*prepared, error) {
+	job := p.jobs[i]
+	if p.inline {
+		job.prep, job.err = p.prepare(p.bu, job)
+		close(job.done)
+	}
+
+	<-job.done
+	return job.prep, job.err
+}
+
+// stop hands out no more jobs, and waits for in-flight ones to finish
+func (p *pipeline) stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+	p.wg.Wait()
+}
+
+// worker returns a copy of bu for the n-th pipeline worker. It shares
+// everything with bu (locks, state, results), but logs with its own
+// name in front, so that it's clear which lines come from where.
+func (bu *build) worker(n int) *build {
+	wb := *bu
+	wb.logger = withPrefix(bu.baseLogger, fmt.Sprintf("[worker %d] ", n))
+	return &wb
+}
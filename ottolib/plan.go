@@ -0,0 +1,286 @@
+package ottolib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProfilePlan describes what a build will do for one profile
+type ProfilePlan struct {
+	Profile *Profile
+	// Build is false if the whole profile is skipped
+	Build    bool
+	Reason   string
+	Packages []*Decision
+}
+
+const (
+	// DisabledDepsSkip skips packages depending on a disabled one (the
+	// default)
+	DisabledDepsSkip = "skip"
+	// DisabledDepsFail fails the build before it starts instead
+	DisabledDepsFail = "fail"
+)
+
+// Decision describes whether and why a package will be built
+type Decision struct {
+	Package *Package
+	Build   bool
+	Reason  string
+}
+
+func (d *Decision) String() string {
+	if d.Build {
+		return fmt.Sprintf("build (%s)", d.Reason)
+	}
+	return fmt.Sprintf("skip (%s)", d.Reason)
+}
+
+func (pp *ProfilePlan) String() string {
+	if pp.Build {
+		return fmt.Sprintf("build (%s)", pp.Reason)
+	}
+	return fmt.Sprintf("skip (%s)", pp.Reason)
+}
+
+// Plan decides what Build would do with opts, for every profile and
+// package, without touching anything on disk. All the selection
+// logic lives here so that it can be explained.
+func (b *Builder) Plan(opts BuildOptions) ([]*ProfilePlan, error) {
+	profiles, err := b.Config.SelectProfiles(opts.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, profile := range profiles {
+		selected[profile.Name] = true
+	}
+	if opts.Resume != "" && b.Config.Package(opts.Resume) == nil {
+		return nil, fmt.Errorf("unknown package %s to resume at", opts.Resume)
+	}
+	if opts.ResumeProfile != "" && b.Config.Profile(opts.ResumeProfile) == nil {
+		return nil, fmt.Errorf("unknown profile %s to resume at", opts.ResumeProfile)
+	}
+
+	var plans []*ProfilePlan
+	skipping := opts.ResumeProfile != ""
+	for _, profile := range b.Config.Profiles {
+		pp := &ProfilePlan{
+			Profile: profile,
+			Build:   true,
+			Reason:  "selected",
+		}
+		plans = append(plans, pp)
+
+		if profile.Name == opts.ResumeProfile {
+			skipping = false
+		}
+
+		if !selected[profile.Name] {
+			pp.Build = false
+			pp.Reason = "not selected by --profile"
+			continue
+		}
+		if skipping {
+			pp.Build = false
+			pp.Reason = fmt.Sprintf("before --resume-profile point %s", opts.ResumeProfile)
+			continue
+		}
+
+		profileOpts := opts
+		if opts.ResumeProfile != "" && opts.ResumeProfile != profile.Name {
+			// that was for the profile we resumed at, this one's built in full
+			profileOpts.Resume = ""
+		}
+
+		decisions, err := b.planPackages(profile, profileOpts)
+		if err != nil {
+			return nil, err
+		}
+		pp.Packages = decisions
+	}
+
+	return plans, nil
+}
+
+// disabledDeps returns a func giving the first disabled package pkg
+// depends on, directly or not, or ""
+func (c *Config) disabledDeps() func(pkg *Package) string {
+	found := make(map[string]string)
+	visiting := make(map[string]bool)
+
+	var disabledDep func(pkg *Package) string
+	disabledDep = func(pkg *Package) string {
+		if dep, ok := found[pkg.Name]; ok {
+			return dep
+		}
+		if visiting[pkg.Name] {
+			// cycles are reported elsewhere
+			return ""
+		}
+		visiting[pkg.Name] = true
+		defer delete(visiting, pkg.Name)
+
+		result := ""
+		for _, name := range pkg.allDeps() {
+			dep := c.Package(name)
+			if dep == nil {
+				continue
+			}
+			if !dep.IsEnabled() {
+				result = dep.Name
+			} else {
+				result = disabledDep(dep)
+			}
+			if result != "" {
+				break
+			}
+		}
+		found[pkg.Name] = result
+		return result
+	}
+	return disabledDep
+}
+
+func (b *Builder) planPackages(profile *Profile, opts BuildOptions) ([]*Decision, error) {
+	packages := b.Config.PackagesFor(profile)
+
+	// requested packages are the ones explicitly asked for, by name or
+	// by tag. needed also has the deps that have to be built for them.
+	var requested map[string]bool
+	var needed map[string]bool
+	var reason string
+
+	if len(opts.Packages) > 0 || len(opts.Tags) > 0 {
+		requested = make(map[string]bool)
+		for _, name := range opts.Packages {
+			requested[name] = true
+		}
+
+		// packages asked for by name always get their deps,
+		// packages asked for by tag only with WithDeps
+		roots := append([]string{}, opts.Packages...)
+		for _, pkg := range packages {
+			if pkg.HasTag(opts.Tags...) {
+				requested[pkg.Name] = true
+				if opts.WithDeps {
+					roots = append(roots, pkg.Name)
+				}
+			}
+		}
+
+		withDeps, err := resolveDeps(b.Config, roots)
+		if err != nil {
+			return nil, err
+		}
+
+		needed = make(map[string]bool)
+		for name := range requested {
+			needed[name] = true
+		}
+		if !opts.SkipDeps {
+			for _, pkg := range withDeps {
+				needed[pkg.Name] = true
+			}
+		}
+
+		var names []string
+		for _, pkg := range packages {
+			if needed[pkg.Name] {
+				names = append(names, pkg.Name)
+			}
+		}
+
+		all, err := resolveDeps(b.Config, names)
+		if err != nil {
+			return nil, err
+		}
+
+		// build in dependency order, then list what's left out
+		var ordered []*Package
+		for _, pkg := range all {
+			if needed[pkg.Name] {
+				ordered = append(ordered, pkg)
+			}
+		}
+		for _, pkg := range packages {
+			if !needed[pkg.Name] {
+				ordered = append(ordered, pkg)
+			}
+		}
+		packages = ordered
+
+		reason = "not needed for the requested packages"
+		if len(opts.Packages) == 0 {
+			reason = fmt.Sprintf("not tagged %s", strings.Join(opts.Tags, " or "))
+		}
+	} else {
+		// building everything still means deps first, a package
+		// listed before its deps in the config doesn't go first
+		inProfile := make(map[string]bool)
+		for _, pkg := range packages {
+			inProfile[pkg.Name] = true
+		}
+
+		all, err := b.Config.BuildOrder(packages)
+		if err != nil {
+			return nil, err
+		}
+
+		var ordered []*Package
+		for _, pkg := range all {
+			if inProfile[pkg.Name] {
+				ordered = append(ordered, pkg)
+			}
+		}
+		packages = ordered
+	}
+
+	disabledDep := b.Config.disabledDeps()
+
+	var decisions []*Decision
+	skipping := opts.Resume != ""
+	for _, pkg := range packages {
+		d := &Decision{
+			Package: pkg,
+			Build:   true,
+			Reason:  "selected",
+		}
+		decisions = append(decisions, d)
+
+		if pkg.Name == opts.Resume {
+			skipping = false
+		}
+
+		switch {
+		case needed != nil && !needed[pkg.Name]:
+			d.Build = false
+			d.Reason = reason
+		case skipping:
+			d.Build = false
+			d.Reason = fmt.Sprintf("before --resume point %s", opts.Resume)
+		case needed != nil && !requested[pkg.Name]:
+			d.Reason = "dependency of the requested packages"
+		}
+
+		if !d.Build {
+			continue
+		}
+		if !pkg.IsEnabled() {
+			d.Build = false
+			d.Reason = "disabled"
+		} else if dep := disabledDep(pkg); dep != "" {
+			switch opts.DisabledDeps {
+			case "", DisabledDepsSkip:
+				d.Build = false
+				d.Reason = fmt.Sprintf("depends on disabled package %s", dep)
+			case DisabledDepsFail:
+				return nil, fmt.Errorf("package %s depends on %s, which is disabled", pkg.Name, dep)
+			default:
+				return nil, fmt.Errorf("unknown disabled deps mode %s", opts.DisabledDeps)
+			}
+		}
+	}
+
+	return decisions, nil
+}
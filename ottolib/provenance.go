@@ -0,0 +1,238 @@
+package ottolib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+const (
+	// ProvenanceBuildType identifies otto builds in SLSA provenance, and
+	// what's in their buildDefinition
+	ProvenanceBuildType = "https://github.com/fasterthanlime/otto/provenance/v1"
+	// ProvenanceBuilderID is the builder.id of otto's provenance
+	ProvenanceBuilderID = "https://github.com/fasterthanlime/otto"
+)
+
+type inTotoStatement struct {
+	Type          string           `json:"_type"`
+	Subject       []*inTotoSubject `json:"subject"`
+	PredicateType string           `json:"predicateType"`
+	Predicate     *slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string                    `json:"buildType"`
+	ExternalParameters   provenanceExternal        `json:"externalParameters"`
+	InternalParameters   provenanceInternal        `json:"internalParameters"`
+	ResolvedDependencies []*slsaResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// provenanceExternal is what was built, and how
+type provenanceExternal struct {
+	Packages []*provenancePackage `json:"packages"`
+}
+
+type provenancePackage struct {
+	Profile       string     `json:"profile"`
+	Name          string     `json:"name"`
+	Sources       string     `json:"sources"`
+	ConfigureArgs []string   `json:"configureArgs,omitempty"`
+	Commands      [][]string `json:"commands"`
+	StartedOn     string     `json:"startedOn"`
+	FinishedOn    string     `json:"finishedOn"`
+}
+
+// provenanceInternal is what the build depended on that isn't in the
+// config: the build environment of each profile
+type provenanceInternal struct {
+	Environments map[string]*EnvFingerprint `json:"environments"`
+}
+
+type slsaResourceDescriptor struct {
+	Name   string            `json:"name"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type slsaRunDetails struct {
+	Builder  slsaBuilder       `json:"builder"`
+	Metadata slsaBuildMetadata `json:"metadata"`
+}
+
+type slsaBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type slsaBuildMetadata struct {
+	InvocationID string `json:"invocationId"`
+	StartedOn    string `json:"startedOn"`
+	FinishedOn   string `json:"finishedOn"`
+}
+
+// WriteProvenance writes an in-toto statement with a SLSA provenance v1
+// predicate to w, describing the packages res says were built: where
+// their sources came from and their checksums, the commands they were
+// configured, built and installed with, each profile's build
+// environment (see EnvFingerprint), and when it all happened. Its
+// subjects are the files in the prefixes that were built, by path.
+func (b *Builder) WriteProvenance(w io.Writer, res *Result) error {
+	external := provenanceExternal{Packages: []*provenancePackage{}}
+	deps := []*slsaResourceDescriptor{}
+	seen := make(map[string]bool)
+	addDep := func(pkg *Package, pr *PackageResult) error {
+		if seen[pkg.Name] {
+			return nil
+		}
+		seen[pkg.Name] = true
+
+		c, err := sbomPackage(pkg, pr)
+		if err != nil {
+			return err
+		}
+		dep := &slsaResourceDescriptor{Name: c.name, URI: c.url}
+		if c.digest != "" {
+			dep.Digest = map[string]string{c.algo: c.digest}
+		}
+		deps = append(deps, dep)
+		return nil
+	}
+
+	for _, pr := range res.Results {
+		if pr.Status != StatusSucceeded {
+			continue
+		}
+		pkg := b.Config.Package(pr.Name)
+		if pkg == nil {
+			continue
+		}
+
+		pp := &provenancePackage{
+			Profile:       pr.Profile,
+			Name:          pr.Name,
+			Sources:       pkg.Sources,
+			ConfigureArgs: pr.ConfigureArgs,
+			Commands:      pr.Commands,
+			StartedOn:     pr.StartTime.UTC().Format(time.RFC3339),
+			FinishedOn:    pr.StartTime.Add(pr.Duration).UTC().Format(time.RFC3339),
+		}
+		if pr.URL != "" {
+			pp.Sources = pr.URL
+		}
+		if pp.Commands == nil {
+			pp.Commands = [][]string{}
+		}
+		external.Packages = append(external.Packages, pp)
+
+		err := addDep(pkg, pr)
+		if err != nil {
+			return err
+		}
+		for i := range pkg.ExtraSources {
+			err := addDep(pkg.extraPackage(i), &PackageResult{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	subjects := []*inTotoSubject{}
+	for _, prefix := range res.Prefixes {
+		prefixSubjects, err := provenanceSubjects(prefix)
+		if err != nil {
+			return err
+		}
+		subjects = append(subjects, prefixSubjects...)
+	}
+
+	environments := res.Fingerprints
+	if environments == nil {
+		environments = make(map[string]*EnvFingerprint)
+	}
+
+	statement := &inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       subjects,
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Predicate: &slsaProvenance{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType:            ProvenanceBuildType,
+				ExternalParameters:   external,
+				InternalParameters:   provenanceInternal{Environments: environments},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: slsaRunDetails{
+				Builder: slsaBuilder{
+					ID:      ProvenanceBuilderID,
+					Version: ottoVersion(),
+				},
+				Metadata: slsaBuildMetadata{
+					InvocationID: newUUID(),
+					StartedOn:    res.StartTime.UTC().Format(time.RFC3339),
+					FinishedOn:   res.StartTime.Add(res.Duration).UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(statement)
+}
+
+// provenanceSubjects hashes every file in prefix, sorted by path
+func provenanceSubjects(prefix string) ([]*inTotoSubject, error) {
+	var subjects []*inTotoSubject
+	err := filepath.Walk(prefix, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		digest, err := computeChecksum(p, "sha256")
+		if err != nil {
+			return err
+		}
+		subjects = append(subjects, &inTotoSubject{
+			Name:   filepath.ToSlash(p),
+			Digest: map[string]string{"sha256": digest},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("while hashing the files in %s: %w", prefix, err)
+	}
+
+	sort.Slice(subjects, func(i, j int) bool {
+		return subjects[i].Name < subjects[j].Name
+	})
+	return subjects, nil
+}
+
+// ottoVersion is otto's version for the provenance builder, if the
+// binary knows it (go install'd ones do)
+func ottoVersion() map[string]string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return nil
+	}
+	return map[string]string{"otto": info.Main.Version}
+}
@@ -0,0 +1,83 @@
+package ottolib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// errChecksumMismatch is what verifyChecksum's errors wrap when the
+// archive's bytes aren't the expected ones
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// recordedChecksums is the file checksums are recorded in the first time
+// archives without one are downloaded (trust on first use), and checked
+// against from then on. It maps sources URLs to checksums like
+// "sha256:...", and is meant to be committed along with the config.
+type recordedChecksums struct {
+	path string
+
+	lock sync.Mutex
+	sums map[string]string
+}
+
+func loadRecordedChecksums(path string) (*recordedChecksums, error) {
+	rc := &recordedChecksums{
+		path: path,
+		sums: make(map[string]string),
+	}
+	err := readJSONFile(path, &rc.sums)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("while reading recorded checksums: %w", err)
+	}
+	return rc, nil
+}
+
+func (rc *recordedChecksums) get(sources string) string {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.sums[sources]
+}
+
+// record adds a checksum and writes the file right away, so that it's
+// kept even if the build fails later on
+func (rc *recordedChecksums) record(sources string, checksum string) error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	rc.sums[sources] = checksum
+	_, err := writeJSONFile(rc.path, rc.sums, true)
+	if err != nil {
+		return fmt.Errorf("while writing recorded checksums: %w", err)
+	}
+	return nil
+}
+
+// fetchRecorded is fetchPackage for packages without a checksum when
+// Download.ChecksumFile is set: the checksum recorded for their sources
+// is verified if there's one, and recorded otherwise
+func (bu *build) fetchRecorded(pkg *Package, dest string, res *PackageResult) error {
+	if recorded := bu.recorded.get(pkg.Sources); recorded != "" {
+		withChecksum := *pkg
+		withChecksum.Checksum = recorded
+		err := bu.fetchSources(&withChecksum, dest, res)
+		if errors.Is(err, errChecksumMismatch) {
+			return withCategory(FailureConfig, fmt.Errorf("the archive for %s changed since its checksum was first recorded in %s, it may have been tampered with: %w",
+				pkg.Sources, bu.recorded.path, err))
+		}
+		return err
+	}
+
+	err := bu.fetchSources(pkg, dest, res)
+	if err != nil {
+		return err
+	}
+
+	digest, err := computeChecksum(dest, "sha256")
+	if err != nil {
+		return err
+	}
+	bu.logger.Infof("Recording checksum of %s in %s", pkg.Sources, bu.recorded.path)
+	return bu.recorded.record(pkg.Sources, "sha256:"+digest)
+}
@@ -0,0 +1,30 @@
+package ottolib
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultMaxRedirects is how many redirects are followed when
+// DownloadOptions doesn't say, the same as net/http
+const defaultMaxRedirects = 10
+
+// checkRedirect logs redirect hops and enforces the redirect options,
+// see http.Client.CheckRedirect
+func (bu *build) checkRedirect(req *http.Request, via []*http.Request) error {
+	bu.logger.Debugf("Redirected from %s to %s", via[len(via)-1].URL, req.URL)
+
+	max := bu.opts.Download.MaxRedirects
+	if max == 0 {
+		max = defaultMaxRedirects
+	}
+	if max < 0 || len(via) > max {
+		return fmt.Errorf("stopped after %d redirects (see --max-redirects)", len(via)-1)
+	}
+
+	if bu.opts.Download.NoCrossHostRedirect && req.URL.Host != via[0].URL.Host {
+		return fmt.Errorf("refusing to follow a redirect from %s to another host, %s", via[0].URL.Host, req.URL.Host)
+	}
+
+	return bu.checkHost(req.URL.String())
+}
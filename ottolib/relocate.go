@@ -0,0 +1,147 @@
+package ottolib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// relocatable reports whether a file's contents have paths that get
+// rewritten as text when relocating: pkg-config files, libtool archives
+// and foo-config scripts
+func relocatable(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".pc" || ext == ".la" || strings.HasSuffix(name, "-config")
+}
+
+var elfMagic = []byte("\x7fELF")
+
+// relocate rewrites the absolute references to prefix in the files
+// installed there so that they point to target instead, once the prefix
+// is done being built: in relocatable() text files, and in the rpaths of
+// ELF binaries if patchelf is around. Files are replaced rather than
+// modified, so that files hard-linked from elsewhere (the store) aren't
+// touched.
+func (bu *build) relocate(prefix string, target string) error {
+	bu.logger.Infof("Relocating %s to %s", prefix, target)
+
+	// /opt/foo shouldn't match in /opt/foobar
+	re := regexp.MustCompile(regexp.QuoteMeta(prefix) + `([^A-Za-z0-9._+-]|$)`)
+	replacement := strings.Replace(target, "$", "$$", -1) + "${1}"
+
+	patchelf, patchelfErr := exec.LookPath("patchelf")
+	var rewritten, skippedELF int
+
+	err := filepath.Walk(prefix, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(prefix, p)
+		if err != nil {
+			return err
+		}
+
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		if bytes.HasPrefix(contents, elfMagic) {
+			if patchelfErr != nil {
+				if bytes.Contains(contents, []byte(prefix)) {
+					skippedELF++
+				}
+				return nil
+			}
+			changed, err := bu.relocateRpath(patchelf, p, info, re, replacement)
+			if err != nil {
+				return fmt.Errorf("while fixing the rpath of %s: %w", rel, err)
+			}
+			if changed {
+				bu.logger.Infof("Relocated rpath of %s", rel)
+				rewritten++
+			}
+			return nil
+		}
+
+		if !relocatable(info.Name()) || bytes.IndexByte(contents, 0) >= 0 {
+			return nil
+		}
+		relocated := re.ReplaceAll(contents, []byte(replacement))
+		if bytes.Equal(relocated, contents) {
+			return nil
+		}
+		err = replaceFile(p, relocated, info.Mode())
+		if err != nil {
+			return err
+		}
+		bu.logger.Infof("Relocated %s", rel)
+		rewritten++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("while relocating %s: %w", prefix, err)
+	}
+
+	if skippedELF > 0 {
+		bu.logger.Warnf("%d binaries reference %s but patchelf isn't in PATH, their rpaths weren't fixed", skippedELF, prefix)
+	}
+	bu.logger.Infof("Relocated %d files to %s", rewritten, target)
+	return nil
+}
+
+// relocateRpath rewrites the prefix in the rpath of the ELF binary at p,
+// if it has one, on a copy that then replaces it
+func (bu *build) relocateRpath(patchelf string, p string, info os.FileInfo, re *regexp.Regexp, replacement string) (bool, error) {
+	out, err := exec.Command(patchelf, "--print-rpath", p).Output()
+	if err != nil {
+		// not every ELF file has a dynamic section
+		return false, nil
+	}
+	rpath := strings.TrimSpace(string(out))
+	relocated := re.ReplaceAllString(rpath, replacement)
+	if relocated == rpath {
+		return false, nil
+	}
+
+	tmp := p + ".relocating"
+	err = copyFile(p, tmp)
+	if err == nil {
+		err = os.Chmod(tmp, info.Mode())
+	}
+	if err == nil {
+		err = exec.Command(patchelf, "--set-rpath", relocated, tmp).Run()
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// replaceFile writes contents to a new file that then replaces p
+func replaceFile(p string, contents []byte, mode os.FileMode) error {
+	tmp := p + ".relocating"
+	err := ioutil.WriteFile(tmp, contents, mode)
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
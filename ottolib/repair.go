@@ -0,0 +1,49 @@
+package ottolib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// brokenReason says why a package looks broken in its prefix, for
+// Repair, or returns "" if it doesn't: it was never built successfully,
+// files it installed are missing from the shared prefix (see
+// State.Owners), or paths from its InstallCheck are missing from its
+// own prefix.
+func (bu *build) brokenReason(pkg *Package, prefix string, pkgPrefix string) string {
+	bu.stateLock.Lock()
+	defer bu.stateLock.Unlock()
+
+	if _, ok := bu.state.Timings[pkg.Name]; !ok {
+		return "never built"
+	}
+
+	var missing []string
+	for rel, owner := range bu.state.Owners {
+		if owner != pkg.Name {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(prefix, rel)); os.IsNotExist(err) {
+			missing = append(missing, rel)
+		}
+	}
+	for _, p := range pkg.InstallCheck {
+		// those it installed are counted already
+		if _, err := os.Stat(filepath.Join(pkgPrefix, p)); err != nil && bu.state.Owners[p] != pkg.Name {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+
+	sort.Strings(missing)
+	shown := missing
+	if len(shown) > 3 {
+		shown = append(shown[:3:3], "...")
+	}
+	return fmt.Sprintf("%d of its files are missing: %s", len(missing), strings.Join(shown, ", "))
+}
@@ -0,0 +1,131 @@
+package ottolib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReportSchemaVersion is bumped whenever a field of Report changes
+// meaning or goes away. New fields may be added without bumping it.
+const ReportSchemaVersion = 1
+
+// Report is the machine-readable version of a Result, meant for
+// dashboards and other tooling. Durations are in seconds.
+type Report struct {
+	SchemaVersion   int              `json:"schemaVersion" yaml:"schemaVersion"`
+	StartTime       time.Time        `json:"startTime" yaml:"startTime"`
+	DurationSeconds float64          `json:"durationSeconds" yaml:"durationSeconds"`
+	Success         bool             `json:"success" yaml:"success"`
+	Error           string           `json:"error,omitempty" yaml:"error,omitempty"`
+	Failure         string           `json:"failure,omitempty" yaml:"failure,omitempty"`
+	ExitCode        int              `json:"exitCode" yaml:"exitCode"`
+	Totals          ReportTotals     `json:"totals" yaml:"totals"`
+	Packages        []*ReportPackage `json:"packages" yaml:"packages"`
+}
+
+type ReportTotals struct {
+	Attempted       int   `json:"attempted" yaml:"attempted"`
+	Succeeded       int   `json:"succeeded" yaml:"succeeded"`
+	Skipped         int   `json:"skipped" yaml:"skipped"`
+	Failed          int   `json:"failed" yaml:"failed"`
+	Pending         int   `json:"pending" yaml:"pending"`
+	BytesDownloaded int64 `json:"bytesDownloaded" yaml:"bytesDownloaded"`
+}
+
+type ReportPackage struct {
+	Profile         string         `json:"profile" yaml:"profile"`
+	Name            string         `json:"name" yaml:"name"`
+	Status          Status         `json:"status" yaml:"status"`
+	Reason          string         `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Error           string         `json:"error,omitempty" yaml:"error,omitempty"`
+	FailedPhase     string         `json:"failedPhase,omitempty" yaml:"failedPhase,omitempty"`
+	Failure         string         `json:"failure,omitempty" yaml:"failure,omitempty"`
+	DurationSeconds float64        `json:"durationSeconds" yaml:"durationSeconds"`
+	BytesDownloaded int64          `json:"bytesDownloaded" yaml:"bytesDownloaded"`
+	URL             string         `json:"url,omitempty" yaml:"url,omitempty"`
+	Phases          []*ReportPhase `json:"phases,omitempty" yaml:"phases,omitempty"`
+	SerialRetry     bool           `json:"serialRetry,omitempty" yaml:"serialRetry,omitempty"`
+	Retries         int            `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Features        []*Feature     `json:"features,omitempty" yaml:"features,omitempty"`
+}
+
+type ReportPhase struct {
+	Name            string  `json:"name" yaml:"name"`
+	DurationSeconds float64 `json:"durationSeconds" yaml:"durationSeconds"`
+}
+
+// Report turns the result into a Report. buildErr is the error
+// Build returned, if any.
+func (r *Result) Report(buildErr error) *Report {
+	report := &Report{
+		SchemaVersion:   ReportSchemaVersion,
+		StartTime:       r.StartTime,
+		DurationSeconds: r.Duration.Seconds(),
+		Success:         buildErr == nil,
+		Totals: ReportTotals{
+			Attempted:       r.Count(StatusSucceeded) + r.Count(StatusFailed),
+			Succeeded:       r.Count(StatusSucceeded),
+			Skipped:         r.Count(StatusSkipped),
+			Failed:          r.Count(StatusFailed),
+			Pending:         r.Count(StatusPending),
+			BytesDownloaded: r.BytesDownloaded(),
+		},
+		Packages: []*ReportPackage{},
+	}
+	if buildErr != nil {
+		report.Error = buildErr.Error()
+		report.Failure = r.FailureCategory(buildErr)
+		report.ExitCode = ExitCode(report.Failure)
+	}
+
+	for _, pr := range r.Results {
+		rp := &ReportPackage{
+			Profile:         pr.Profile,
+			Name:            pr.Name,
+			Status:          pr.Status,
+			Reason:          pr.Reason,
+			FailedPhase:     pr.FailedPhase,
+			Failure:         pr.Failure,
+			DurationSeconds: pr.Duration.Seconds(),
+			BytesDownloaded: pr.BytesDownloaded,
+			URL:             pr.URL,
+			SerialRetry:     pr.SerialRetry,
+			Retries:         pr.Retries,
+			Features:        pr.Features,
+		}
+		if pr.Err != nil {
+			rp.Error = pr.Err.Error()
+		}
+		for _, phase := range pr.Phases {
+			rp.Phases = append(rp.Phases, &ReportPhase{
+				Name:            phase.Name,
+				DurationSeconds: phase.Duration.Seconds(),
+			})
+		}
+		report.Packages = append(report.Packages, rp)
+	}
+
+	return report
+}
+
+// WriteReport writes the result to w in the given format: "text"
+// (the same as PrintSummary), "json" or "yaml"
+func (r *Result) WriteReport(w io.Writer, format string, buildErr error) error {
+	switch format {
+	case "", "text":
+		r.PrintSummary(w)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r.Report(buildErr))
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(r.Report(buildErr))
+	default:
+		return fmt.Errorf("unknown report format %s", format)
+	}
+}
@@ -0,0 +1,56 @@
+package ottolib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolverArgs is the package's ResolverCommand, getting sources to dest
+func resolverArgs(pkg *Package, sources string, dest string) []string {
+	replacer := strings.NewReplacer("$SOURCES", sources, "$DEST", dest)
+	args := make([]string, len(pkg.ResolverCommand))
+	for i, arg := range pkg.ResolverCommand {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
+
+// resolve is download for packages with a ResolverCommand: the command
+// writes the archive for sources to a .part file, which is renamed to
+// dest once it's verified
+func (bu *build) resolve(pkg *Package, sources string, dest string, res *PackageResult) error {
+	bu.logger.Infof("Resolving %s with %s", sources, pkg.ResolverCommand[0])
+
+	part := partPath(dest)
+	// a .part from an interrupted download or attempt isn't the command's
+	// doing, and would pass for the archive if it wrote nothing
+	err := os.Remove(part)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("while removing stale download %s: %w", part, err)
+	}
+
+	args := resolverArgs(pkg, sources, part)
+	err = bu.command(filepath.Dir(dest), args[0], nil, args[1:]...)
+	if err != nil {
+		return fmt.Errorf("resolver command %s failed: %w", args[0], err)
+	}
+
+	stat, err := os.Stat(part)
+	if err != nil {
+		return fmt.Errorf("resolver command %s succeeded but didn't write the archive: %w", args[0], err)
+	}
+	res.BytesDownloaded += stat.Size()
+
+	err = bu.verifyChecksum(part, pkg.Checksum)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(part, dest)
+	if err != nil {
+		return fmt.Errorf("while moving download into place: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package ottolib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusSucceeded Status = "succeeded"
+	StatusSkipped   Status = "skipped"
+	StatusFailed    Status = "failed"
+)
+
+type PhaseResult struct {
+	Name     string
+	Duration time.Duration
+}
+
+type PackageResult struct {
+	Profile string
+	Name    string
+	Status  Status
+	// Reason explains why a package was skipped
+	Reason string
+	Err    error
+	// FailedPhase is the phase Err happened in, like "configure"
+	FailedPhase     string
+	StartTime       time.Time
+	Duration        time.Duration
+	Phases          []*PhaseResult
+	BytesDownloaded int64
+	// URL is where the archive was downloaded from in the
+	// end, after mirrors and redirects
+	URL string
+	// SerialRetry is set if make had to be retried with -j1
+	SerialRetry bool
+	// Retries is how many times the package had to be built again,
+	// see Package.Retries
+	Retries int
+	// Archive is where the package's archive was downloaded to
+	Archive string
+	// CacheHit is set if the archive didn't have to be downloaded: it
+	// was in the cache, already there, or not modified on the server
+	CacheHit bool
+	// Failure is the category Err falls in, see the Failure* constants
+	Failure string
+	// Features are those configure found, with ReportFeatures
+	Features []*Feature
+	// ConfigureArgs are the args configure was run with, otto's own
+	// included
+	ConfigureArgs []string
+	// Commands are those the package was configured, built and
+	// installed with, in the order they were run
+	Commands [][]string
+}
+
+// phase runs f, recording how long it took under the given name
+func (pr *PackageResult) phase(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	pr.Phases = append(pr.Phases, &PhaseResult{
+		Name:     name,
+		Duration: time.Since(start),
+	})
+	if err != nil && pr.FailedPhase == "" {
+		pr.FailedPhase = name
+	}
+	return err
+}
+
+// ran records a command the package was built with, see Commands
+func (pr *PackageResult) ran(exe string, args ...string) {
+	pr.Commands = append(pr.Commands, append([]string{exe}, args...))
+}
+
+// finish marks the package as succeeded or failed depending on err
+func (pr *PackageResult) finish(err error) {
+	pr.Duration = time.Since(pr.StartTime)
+	pr.Err = err
+	if err != nil {
+		pr.Status = StatusFailed
+		pr.Failure = categoryOf(pr.FailedPhase, err)
+	} else {
+		pr.Status = StatusSucceeded
+	}
+}
+
+// Result describes what happened during a build
+type Result struct {
+	StartTime time.Time
+	Duration  time.Duration
+	Results   []*PackageResult
+	// Prefixes lists the install prefix of every profile that was built
+	Prefixes []string
+	// Fingerprints are the build environments of the profiles that
+	// were built, by name
+	Fingerprints map[string]*EnvFingerprint
+}
+
+func newResult() *Result {
+	return &Result{
+		StartTime:    time.Now(),
+		Fingerprints: make(map[string]*EnvFingerprint),
+	}
+}
+
+// add starts tracking a package for the given profile
+func (r *Result) add(profile *Profile, pkg *Package) *PackageResult {
+	pr := &PackageResult{
+		Profile:   profile.Name,
+		Name:      pkg.Name,
+		Status:    StatusPending,
+		StartTime: time.Now(),
+	}
+	r.Results = append(r.Results, pr)
+	return pr
+}
+
+func (r *Result) finish() {
+	r.Duration = time.Since(r.StartTime)
+}
+
+func (r *Result) Count(status Status) int {
+	count := 0
+	for _, pr := range r.Results {
+		if pr.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Result) BytesDownloaded() int64 {
+	var total int64
+	for _, pr := range r.Results {
+		total += pr.BytesDownloaded
+	}
+	return total
+}
+
+// Slowest returns the n packages that took the longest, slowest first
+func (r *Result) Slowest(n int) []*PackageResult {
+	var built []*PackageResult
+	for _, pr := range r.Results {
+		if pr.Status == StatusSucceeded || pr.Status == StatusFailed {
+			built = append(built, pr)
+		}
+	}
+
+	sort.SliceStable(built, func(i, j int) bool {
+		return built[i].Duration > built[j].Duration
+	})
+
+	if len(built) > n {
+		built = built[:n]
+	}
+	return built
+}
+
+// PrintSummary writes a short human-readable summary of the run to w
+func (r *Result) PrintSummary(w io.Writer) {
+	attempted := r.Count(StatusSucceeded) + r.Count(StatusFailed)
+
+	fmt.Fprintf(w, "\n=== otto summary ===\n")
+	fmt.Fprintf(w, "Packages:   %d attempted, %d succeeded, %d skipped, %d failed\n",
+		attempted, r.Count(StatusSucceeded), r.Count(StatusSkipped), r.Count(StatusFailed))
+	if pending := r.Count(StatusPending); pending > 0 {
+		fmt.Fprintf(w, "            %d not reached\n", pending)
+	}
+	fmt.Fprintf(w, "Downloaded: %s\n", humanize.IBytes(uint64(r.BytesDownloaded())))
+	fmt.Fprintf(w, "Wall time:  %s\n", r.Duration.Round(time.Millisecond))
+
+	slowest := r.Slowest(3)
+	if len(slowest) > 0 {
+		fmt.Fprintf(w, "Slowest:\n")
+		for _, pr := range slowest {
+			fmt.Fprintf(w, "  %s/%s: %s (%s)\n", pr.Profile, pr.Name, pr.Duration.Round(time.Millisecond), pr.Status)
+		}
+	}
+
+	for _, pr := range r.Results {
+		if pr.SerialRetry {
+			fmt.Fprintf(w, "Needed -j1: %s/%s (%s)\n", pr.Profile, pr.Name, pr.Status)
+		}
+	}
+
+	for _, pr := range r.Results {
+		if pr.Retries > 0 {
+			fmt.Fprintf(w, "Retried: %s/%s x%d (%s)\n", pr.Profile, pr.Name, pr.Retries, pr.Status)
+		}
+	}
+
+	for _, pr := range r.Results {
+		if pr.Status == StatusFailed {
+			fmt.Fprintf(w, "Failed: %s/%s (%s step): %s\n", pr.Profile, pr.Name, pr.FailedPhase, pr.Err)
+		}
+	}
+
+	if failed := r.Count(StatusFailed); failed > 0 {
+		category, count := r.dominantFailure()
+		fmt.Fprintf(w, "Failure:    mostly %s (%d of %d failed packages, exit code %d)\n", category, count, failed, ExitCode(category))
+	}
+}
@@ -0,0 +1,78 @@
+package ottolib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// retryOnValues are what Package.RetryOn can have: failure categories,
+// and the steps a failure can happen in
+var retryOnValues = []string{FailureNetwork, FailureTimeout, "extract", "configure", "build", "install"}
+
+func checkRetryOn(pkg *Package) error {
+	if pkg.Retries < 0 {
+		return fmt.Errorf("package %s: retries can't be negative", pkg.Name)
+	}
+	for _, r := range pkg.RetryOn {
+		known := false
+		for _, v := range retryOnValues {
+			if r == v {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("package %s: can't retry on %s, only on %v", pkg.Name, r, retryOnValues)
+		}
+	}
+	return nil
+}
+
+// retryable reports whether a package that failed with err is worth
+// building again, going by its RetryOn. Config failures never are, and
+// nothing is once the deadline is past.
+func (bu *build) retryable(pkg *Package, res *PackageResult, err error) bool {
+	phase := res.FailedPhase
+	if strings.HasPrefix(phase, "step ") {
+		// BuildSteps replace configure, build and install
+		phase = "build"
+	}
+	category := categoryOf(res.FailedPhase, err)
+	if category == FailureConfig || category == FailureDeadline || bu.pastDeadline() || bu.ctx.Err() != nil {
+		return false
+	}
+	if len(pkg.RetryOn) == 0 {
+		return true
+	}
+	for _, r := range pkg.RetryOn {
+		if r == category || r == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareRetry gets a package that failed ready to be prepared again:
+// its source directory is wiped on the next extraction, and its result
+// forgets about the failure
+func (bu *build) prepareRetry(profile *Profile, pkg *Package, res *PackageResult, err error) error {
+	res.Retries++
+	bu.logger.Warnf("Retrying %s (attempt %d of %d), it failed in the %s step: %s",
+		pkg.Name, res.Retries+1, pkg.Retries+1, res.FailedPhase, err)
+
+	pkgSrc, err := bu.pkgSrcDir(profile.Name, pkg.Name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(pkgSrc, extractedMarker))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	res.FailedPhase = ""
+	res.SerialRetry = false
+	res.ConfigureArgs = nil
+	res.Commands = nil
+	return nil
+}
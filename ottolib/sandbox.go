@@ -0,0 +1,161 @@
+package ottolib
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultSandboxPaths are made visible (read-only) in the sandbox on top
+// of SandboxPaths, so that there's a shell and coreutils to run configure
+// with. The dynamic loader and the C library they need are too, see
+// sandboxRuntimeArgs. Host headers in /usr/include and the rest of
+// /usr/lib are deliberately not in there: allow them (or your
+// toolchain's) explicitly.
+var defaultSandboxPaths = []string{
+	"/bin",
+	"/sbin",
+	"/usr/bin",
+	"/usr/sbin",
+	"/usr/libexec",
+	"/etc",
+}
+
+// sandboxLibDirs are where dynamic loaders live, or symlinks to them
+var sandboxLibDirs = []string{"/lib", "/lib32", "/lib64", "/libx32"}
+
+// sandboxRuntimeArgs are the bwrap args that make /bin/sh's dynamic
+// loader visible in the sandbox, along with the directory it resolves
+// to, where the C library is too on glibc and musl systems. Without
+// them nothing can even be exec'd. On merged-/usr systems /lib and
+// friends are symlinks, which are recreated as such. On those, the C
+// library's directory (like /usr/lib/x86_64-linux-gnu) also has the
+// development symlinks and static archives of host libraries, which
+// can't be told apart from it: only /usr/include is hidden there.
+func sandboxRuntimeArgs() []string {
+	var args []string
+	bound := make(map[string]bool)
+	bind := func(dir string) {
+		for p := dir; ; p = filepath.Dir(p) {
+			if bound[p] {
+				return
+			}
+			if p == "/" || p == "." {
+				break
+			}
+		}
+		bound[dir] = true
+		args = append(args, "--ro-bind", dir, dir)
+	}
+
+	for _, p := range sandboxLibDirs {
+		info, err := os.Lstat(p)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err == nil {
+				args = append(args, "--symlink", target, p)
+			}
+			continue
+		}
+		bind(p)
+	}
+
+	// follow the loader's symlinks, each one has to resolve in there
+	p := elfInterpreter("/bin/sh")
+	for i := 0; p != "" && i < 16; i++ {
+		if dir, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+			bind(dir)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		p = target
+	}
+	return args
+}
+
+// elfInterpreter returns the dynamic loader of the ELF binary at p, or
+// "" if it's static, or not ELF
+func elfInterpreter(p string) string {
+	f, err := elf.Open(p)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		interp, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return ""
+		}
+		return strings.TrimRight(string(interp), "\x00")
+	}
+	return ""
+}
+
+// sandboxed returns exe and args wrapped so that they run in a bwrap
+// sandbox where only the outdir, prefix and allowed paths are visible
+func (bu *build) sandboxed(dir string, prefix string, exe string, args []string) (string, []string, error) {
+	bwrap, err := exec.LookPath("bwrap")
+	if err != nil {
+		return "", nil, fmt.Errorf("--sandbox needs bubblewrap (bwrap) in PATH: %w", err)
+	}
+
+	wrapped := []string{
+		"--die-with-parent",
+		"--unshare-all",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+	}
+	for _, p := range defaultSandboxPaths {
+		wrapped = append(wrapped, "--ro-bind-try", p, p)
+	}
+	wrapped = append(wrapped, sandboxRuntimeArgs()...)
+	for _, p := range bu.opts.SandboxPaths {
+		wrapped = append(wrapped, "--ro-bind", p, p)
+	}
+	wrapped = append(wrapped,
+		"--bind", bu.opts.OutDir, bu.opts.OutDir,
+		"--bind", prefix, prefix,
+		"--chdir", dir,
+		"--", exe,
+	)
+	wrapped = append(wrapped, args...)
+
+	return bwrap, wrapped, nil
+}
+
+// buildCommand is like command, but runs in the sandbox if asked to.
+// It's used for the configure, build and install steps.
+func (bu *build) buildCommand(dir string, prefix string, exe string, envIn []string, args ...string) error {
+	return bu.buildCommandTee(dir, prefix, nil, exe, envIn, args...)
+}
+
+// buildCommandTee is buildCommand with commandTee's tee
+func (bu *build) buildCommandTee(dir string, prefix string, tee io.Writer, exe string, envIn []string, args ...string) error {
+	if bu.opts.Sandbox {
+		var err error
+		exe, args, err = bu.sandboxed(dir, prefix, exe, args)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bu.runCommand(bu.limits, dir, tee, exe, envIn, args...)
+}
@@ -0,0 +1,357 @@
+package ottolib
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// SBOMCycloneDX is the CycloneDX 1.4 JSON format
+	SBOMCycloneDX = "cyclonedx"
+	// SBOMSPDX is the SPDX 2.3 JSON format
+	SBOMSPDX = "spdx"
+)
+
+// sbomComponent is what SBOMs say about a package, whichever the format
+type sbomComponent struct {
+	name    string
+	version string
+	url     string
+	// algo is as in checksums (sha1, sha256, sha512)
+	algo   string
+	digest string
+	deps   []string
+}
+
+// WriteSBOM writes a software bill of materials to w, in the given
+// format (see the SBOM* constants), listing the packages res says were
+// built, with their sources and checksums. Packages built for several
+// profiles are only listed once, build-only ones (see Package.BuildDeps)
+// not at all. Archives without a configured checksum are hashed if
+// they're still around.
+func (b *Builder) WriteSBOM(w io.Writer, format string, res *Result) error {
+	buildOnly := b.Config.buildOnly()
+	var components []*sbomComponent
+	seen := make(map[string]bool)
+	for _, pr := range res.Results {
+		if pr.Status != StatusSucceeded || seen[pr.Name] || buildOnly[pr.Name] {
+			continue
+		}
+		pkg := b.Config.Package(pr.Name)
+		if pkg == nil {
+			continue
+		}
+		seen[pr.Name] = true
+
+		c, err := sbomPackage(pkg, pr)
+		if err != nil {
+			return err
+		}
+		components = append(components, c)
+
+		for i := range pkg.ExtraSources {
+			extraPkg := pkg.extraPackage(i)
+			c, err := sbomPackage(extraPkg, &PackageResult{})
+			if err != nil {
+				return err
+			}
+			components = append(components, c)
+		}
+	}
+
+	// deps on packages that weren't built don't belong in there
+	for _, c := range components {
+		var deps []string
+		for _, dep := range c.deps {
+			if seen[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		c.deps = deps
+	}
+
+	var doc interface{}
+	switch format {
+	case "", SBOMCycloneDX:
+		doc = cycloneDX(components)
+	case SBOMSPDX:
+		doc = spdx(components)
+	default:
+		return fmt.Errorf("unknown SBOM format %s", format)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func sbomPackage(pkg *Package, pr *PackageResult) (*sbomComponent, error) {
+	c := &sbomComponent{
+		name:    pkg.Name,
+		version: pkg.Version,
+		url:     pkg.Sources,
+		deps:    pkg.Deps,
+	}
+	if pr.URL != "" {
+		c.url = pr.URL
+	}
+	if c.version == "" {
+		c.version = guessVersion(pkg.Sources)
+	}
+
+	checksum := pkg.Checksum
+	if checksum == "" && pr.Archive != "" {
+		digest, err := computeChecksum(pr.Archive, "sha256")
+		if err == nil {
+			checksum = "sha256:" + digest
+		}
+	}
+	if checksum != "" {
+		_, digest, err := parseChecksum(checksum)
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", pkg.Name, err)
+		}
+		c.algo = "sha256"
+		if i := strings.Index(checksum, ":"); i >= 0 {
+			c.algo = checksum[:i]
+		}
+		c.digest = digest
+	}
+
+	return c, nil
+}
+
+var versionInName = regexp.MustCompile(`[-_]v?([0-9][0-9A-Za-z.+~-]*?)(\.tar\.[a-z0-9]+|\.tgz|\.zip)?$`)
+
+// guessVersion finds the version in an archive URL like
+// https://example.org/foo-1.2.3.tar.gz, or returns ""
+func guessVersion(sources string) string {
+	u, err := url.Parse(sources)
+	if err != nil {
+		return ""
+	}
+
+	m := versionInName.FindStringSubmatch(path.Base(u.Path))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// purl is the package URL (https://github.com/package-url/purl-spec)
+// of a component. otto packages don't come from any package manager,
+// so they're "generic", with where they were downloaded from.
+func (c *sbomComponent) purl() string {
+	p := "pkg:generic/" + url.PathEscape(c.name)
+	if c.version != "" {
+		p += "@" + url.PathEscape(c.version)
+	}
+	if c.url != "" {
+		p += "?download_url=" + url.QueryEscape(c.url)
+	}
+	return p
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []*cdxComponent `json:"components"`
+	Dependencies []*cdxDep       `json:"dependencies,omitempty"`
+}
+
+type cdxMetadata struct {
+	Timestamp string     `json:"timestamp"`
+	Tools     []*cdxTool `json:"tools"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	Type               string     `json:"type"`
+	BOMRef             string     `json:"bom-ref"`
+	Name               string     `json:"name"`
+	Version            string     `json:"version,omitempty"`
+	PURL               string     `json:"purl"`
+	Hashes             []*cdxHash `json:"hashes,omitempty"`
+	ExternalReferences []*cdxRef  `json:"externalReferences,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxRef struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxDep struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func cycloneDX(components []*sbomComponent) *cdxBOM {
+	bom := &cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     []*cdxTool{{Name: "otto"}},
+		},
+		Components: []*cdxComponent{},
+	}
+
+	for _, c := range components {
+		cc := &cdxComponent{
+			Type:    "library",
+			BOMRef:  c.name,
+			Name:    c.name,
+			Version: c.version,
+			PURL:    c.purl(),
+		}
+		if c.digest != "" {
+			// sha256 -> SHA-256
+			cc.Hashes = []*cdxHash{{Alg: strings.ToUpper(c.algo[:3]) + "-" + c.algo[3:], Content: c.digest}}
+		}
+		if c.url != "" {
+			cc.ExternalReferences = []*cdxRef{{Type: "distribution", URL: c.url}}
+		}
+		bom.Components = append(bom.Components, cc)
+
+		if len(c.deps) > 0 {
+			bom.Dependencies = append(bom.Dependencies, &cdxDep{Ref: c.name, DependsOn: c.deps})
+		}
+	}
+
+	return bom
+}
+
+type spdxDocument struct {
+	SPDXVersion       string              `json:"spdxVersion"`
+	DataLicense       string              `json:"dataLicense"`
+	SPDXID            string              `json:"SPDXID"`
+	Name              string              `json:"name"`
+	DocumentNamespace string              `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo    `json:"creationInfo"`
+	Packages          []*spdxPackage      `json:"packages"`
+	Relationships     []*spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string          `json:"name"`
+	SPDXID           string          `json:"SPDXID"`
+	VersionInfo      string          `json:"versionInfo,omitempty"`
+	DownloadLocation string          `json:"downloadLocation"`
+	FilesAnalyzed    bool            `json:"filesAnalyzed"`
+	LicenseConcluded string          `json:"licenseConcluded"`
+	LicenseDeclared  string          `json:"licenseDeclared"`
+	CopyrightText    string          `json:"copyrightText"`
+	Checksums        []*spdxChecksum `json:"checksums,omitempty"`
+	ExternalRefs     []*spdxRef      `json:"externalRefs"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+var spdxIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+func spdxID(name string) string {
+	return "SPDXRef-Package-" + spdxIDUnsafe.ReplaceAllString(name, "-")
+}
+
+func spdx(components []*sbomComponent) *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              "otto build",
+		DocumentNamespace: "https://spdx.org/spdxdocs/otto-" + newUUID(),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: otto"},
+		},
+		Packages:      []*spdxPackage{},
+		Relationships: []*spdxRelationship{},
+	}
+
+	for _, c := range components {
+		sp := &spdxPackage{
+			Name:             c.name,
+			SPDXID:           spdxID(c.name),
+			VersionInfo:      c.version,
+			DownloadLocation: c.url,
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []*spdxRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  c.purl(),
+			}},
+		}
+		if sp.DownloadLocation == "" {
+			sp.DownloadLocation = "NOASSERTION"
+		}
+		if c.digest != "" {
+			sp.Checksums = []*spdxChecksum{{Algorithm: strings.ToUpper(c.algo), ChecksumValue: c.digest}}
+		}
+		doc.Packages = append(doc.Packages, sp)
+
+		doc.Relationships = append(doc.Relationships, &spdxRelationship{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: sp.SPDXID,
+		})
+		for _, dep := range c.deps {
+			doc.Relationships = append(doc.Relationships, &spdxRelationship{
+				SPDXElementID:      sp.SPDXID,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: spdxID(dep),
+			})
+		}
+	}
+
+	return doc
+}
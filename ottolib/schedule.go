@@ -0,0 +1,60 @@
+package ottolib
+
+const (
+	// ScheduleOrder builds packages in dependency order, then
+	// config order (the default)
+	ScheduleOrder = "order"
+	// ScheduleLPT builds the packages that took longest last time
+	// first, as far as dependencies allow
+	ScheduleLPT = "lpt"
+)
+
+// lptOrder reorders decisions so that, among the packages whose deps
+// come earlier, the one with the longest recorded timing goes first.
+// Packages with no timing keep their relative order, so that with no
+// history at all, nothing moves.
+func lptOrder(decisions []*Decision, timings map[string]float64) []*Decision {
+	index := make(map[string]int)
+	for i, d := range decisions {
+		index[d.Package.Name] = i
+	}
+
+	placed := make([]bool, len(decisions))
+	ready := func(d *Decision) bool {
+		for _, dep := range d.Package.allDeps() {
+			// deps that aren't in the list are someone else's problem
+			if i, ok := index[dep]; ok && !placed[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var ordered []*Decision
+	for len(ordered) < len(decisions) {
+		best := -1
+		for i, d := range decisions {
+			if placed[i] || !ready(d) {
+				continue
+			}
+			if best < 0 || timings[d.Package.Name] > timings[decisions[best].Package.Name] {
+				best = i
+			}
+		}
+
+		if best < 0 {
+			// a cycle, which Plan should have caught: keep the rest as is
+			for i, d := range decisions {
+				if !placed[i] {
+					ordered = append(ordered, d)
+				}
+			}
+			break
+		}
+
+		placed[best] = true
+		ordered = append(ordered, decisions[best])
+	}
+
+	return ordered
+}
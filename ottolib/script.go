@@ -0,0 +1,420 @@
+package ottolib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// WriteScript writes a bash script to w that downloads, extracts and
+// builds what Build would with opts, without otto. It's meant for
+// auditing and for reproducing builds by hand, so it's as close as
+// possible to what Build runs, with a few exceptions noted as comments
+// in the script (sandboxing, merged prefixes, checks otto does itself).
+func (b *Builder) WriteScript(w io.Writer, opts BuildOptions) error {
+	outDir, err := filepath.Abs(opts.OutDir)
+	if err != nil {
+		return fmt.Errorf("while absolutizing outDir: %w", err)
+	}
+	opts.OutDir = outDir
+
+	if opts.MakeJobs <= 0 {
+		opts.MakeJobs = 1
+	}
+
+	plans, err := b.Plan(opts)
+	if err != nil {
+		return err
+	}
+
+	bu, err := b.newBuild(context.Background(), opts, newResult())
+	if err != nil {
+		return err
+	}
+
+	sw := &scriptWriter{w: bufio.NewWriter(w)}
+	sw.line("#!/usr/bin/env bash")
+	sw.line("# Generated by otto script, does what otto build would")
+	sw.line("set -euo pipefail")
+
+	for _, pp := range plans {
+		sw.line("")
+		if !pp.Build {
+			sw.line("# skipping profile %s (%s)", pp.Profile.Name, pp.Reason)
+			continue
+		}
+
+		err = bu.scriptProfile(sw, pp.Profile, pp.Packages)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sw.w.Flush()
+}
+
+func (bu *build) scriptProfile(sw *scriptWriter, profile *Profile, decisions []*Decision) error {
+	src, prefix, err := bu.profileDirs(profile)
+	if err != nil {
+		return err
+	}
+
+	sw.line("### profile %s", profile.Name)
+	sw.command("mkdir", "-p", src, prefix)
+	if bu.opts.Sandbox {
+		sw.line("# note: otto would run build steps in a bwrap sandbox")
+	}
+
+	buildOnly := bu.config.buildOnly()
+
+	var inherited []string
+	for _, d := range decisions {
+		pkg := d.Package
+		sw.line("")
+		if !d.Build {
+			sw.line("# skipping %s (%s)", pkg.Name, d.Reason)
+			continue
+		}
+
+		pkgPrefix, earlier := bu.sharedPrefix(profile, prefix, pkg, buildOnly)
+		if bu.opts.PrefixPerPackage {
+			pkgPrefix = packagePrefix(prefix, pkg)
+			earlier = inherited
+			inherited = append(inherited, pkgPrefix)
+		}
+
+		err := bu.scriptPackage(sw, profile, pkg, pkgPrefix, earlier)
+		if err != nil {
+			return fmt.Errorf("while writing script for %s: %w", pkg.Name, err)
+		}
+	}
+
+	if bu.opts.PrefixPerPackage && bu.opts.MergePrefix {
+		sw.line("")
+		sw.line("# note: otto would merge the package prefixes into %s", filepath.Join(prefix, "merged"))
+	}
+
+	return nil
+}
+
+func (bu *build) scriptPackage(sw *scriptWriter, profile *Profile, pkg *Package, prefix string, inherited []string) error {
+	expand := func(s string) string {
+		return strings.Replace(s, "$PREFIX", prefix, -1)
+	}
+	env := bu.buildEnv(profile, pkg, prefix, inherited, expand)
+	// only build commands get the profile's CommandWrapper here
+	wrap := func(args ...string) string {
+		return shellJoin(append(append([]string{}, profile.CommandWrapper...), args...))
+	}
+
+	sw.line("## %s", pkg.Name)
+	pkgSrc, err := bu.pkgSrcDir(profile.Name, pkg.Name)
+	if err != nil {
+		return err
+	}
+	sw.command("mkdir", "-p", pkgSrc)
+
+	format, err := formatForPackage(pkg)
+	if err != nil {
+		return err
+	}
+	if format == FormatDir {
+		dir, _ := localPath(pkg.Sources)
+		dest := filepath.Join(pkgSrc, filepath.Base(dir))
+		if canonical := pkg.canonicalDir(); canonical != "" {
+			dest = filepath.Join(pkgSrc, canonical)
+		}
+		sw.command("rm", "-rf", dest)
+		sw.command("cp", "-R", dir, dest)
+		sw.line("srcdir=%s", shellQuote(filepath.Join(dest, pkg.SourceDir)))
+	} else {
+		archive := filepath.Join(pkgSrc, bu.archiveName(pkg, format))
+		bu.scriptDownload(sw, pkg, archive)
+
+		for _, argv := range pkg.VerifyCommand {
+			var args []string
+			for _, arg := range argv {
+				args = append(args, strings.Replace(arg, "$ARCHIVE", archive, -1))
+			}
+			sw.line("(cd %s && %s)", shellQuote(pkgSrc), shellJoin(args))
+		}
+
+		if len(pkg.ExtractCommand) > 0 {
+			replacer := strings.NewReplacer("$ARCHIVE", archive, "$DEST", pkgSrc)
+			for _, argv := range pkg.ExtractCommand {
+				var args []string
+				for _, arg := range argv {
+					args = append(args, replacer.Replace(arg))
+				}
+				sw.line("(cd %s && %s)", shellQuote(pkgSrc), shellJoin(args))
+			}
+		} else {
+			untar, err := bu.scriptUntar(format, archive, pkgSrc, 0, pkg.ExtractInclude, pkg.ExtractExclude)
+			if err != nil {
+				return err
+			}
+			sw.line("%s", untar)
+		}
+
+		switch {
+		case pkg.SourceDir != "":
+			sw.line("srcdir=%s", shellQuote(filepath.Join(pkgSrc, pkg.SourceDir)))
+		case pkg.Flat:
+			sw.line("srcdir=%s", shellQuote(pkgSrc))
+		case pkg.canonicalDir() != "":
+			canonical := shellQuote(filepath.Join(pkgSrc, pkg.canonicalDir()))
+			sw.line("for d in %s/*/; do d=\"${d%%/}\"; [ \"$d\" = %s ] && continue; rm -rf %s && mv \"$d\" %s; break; done",
+				shellQuote(pkgSrc), canonical, canonical, canonical)
+			sw.line("srcdir=%s", canonical)
+		default:
+			// otto makes sure there's only the one
+			sw.line("srcdir=\"$(for d in %s/*/; do echo \"${d%%/}\"; break; done)\"", shellQuote(pkgSrc))
+		}
+	}
+
+	for i, extra := range pkg.ExtraSources {
+		extraPkg := pkg.extraPackage(i)
+		extraFormat, err := formatForPackage(extraPkg)
+		if err != nil {
+			return err
+		}
+		dest := "$srcdir/" + extra.Dest
+		if extraFormat == FormatDir {
+			dir, _ := localPath(extraPkg.Sources)
+			sw.line("rm -rf \"%s\" && cp -R %s \"%s\"", dest, shellQuote(dir), dest)
+			continue
+		}
+
+		extraArchive := filepath.Join(pkgSrc, bu.archiveName(extraPkg, extraFormat))
+		bu.scriptDownload(sw, extraPkg, extraArchive)
+
+		strip := 1
+		if extra.Flat {
+			strip = 0
+		}
+		sw.line("mkdir -p \"%s\"", dest)
+		untar, err := bu.scriptUntar(extraFormat, extraArchive, "@DEST@", strip, nil, nil)
+		if err != nil {
+			return err
+		}
+		sw.line("%s", strings.Replace(untar, "@DEST@", "\""+dest+"\"", 1))
+	}
+
+	// everything else happens in a subshell, so that the env and
+	// umask don't leak into the next package
+	sw.line("(")
+	sw.line("cd \"$srcdir\"")
+	hostPath := os.Getenv("PATH")
+	for _, kv := range env {
+		if !strings.Contains(kv, "=") {
+			sw.line("unset %s", kv)
+			continue
+		}
+		if strings.HasPrefix(kv, "PATH=") && hostPath != "" && strings.HasSuffix(kv, hostPath) {
+			// use the PATH of whoever runs the script, not ours
+			sw.line("export PATH=%s\"$PATH\"", shellQuote(strings.TrimSuffix(strings.TrimPrefix(kv, "PATH="), hostPath)))
+			continue
+		}
+		sw.line("export %s", shellQuote(kv))
+	}
+	if bu.opts.SourceDateEpoch > 0 {
+		sw.line("export SOURCE_DATE_EPOCH=%d", bu.opts.SourceDateEpoch)
+	} else if profile.SourceDateEpoch == SourceDateEpochArchive {
+		sw.line("# note: otto would set SOURCE_DATE_EPOCH from the newest file in the archive")
+	} else if profile.SourceDateEpoch != "" {
+		sw.line("export SOURCE_DATE_EPOCH=%s", shellQuote(profile.SourceDateEpoch))
+	}
+
+	buildDir := pkg.BuildDir
+	if buildDir == "" {
+		buildDir = pkg.ConfigureDir
+	}
+
+	if len(pkg.BuildSteps) > 0 {
+		shell := pkg.Shell
+		if shell == "" {
+			shell = defaultShell
+		}
+		if buildDir != "" {
+			sw.line("cd \"$srcdir\"/%s", shellQuote(buildDir))
+		}
+		for _, step := range pkg.BuildSteps {
+			if step.Shell != "" {
+				sw.line("%s", wrap(shell, "-c", step.Shell))
+				continue
+			}
+			var args []string
+			for _, arg := range step.Args {
+				args = append(args, expand(arg))
+			}
+			sw.line("%s", wrap(args...))
+		}
+		sw.line(")")
+		scriptInstallCheck(sw, pkg, prefix)
+		return nil
+	}
+
+	cmds, err := bu.packageCommands(profile, pkg, prefix, env, expand)
+	if err != nil {
+		return err
+	}
+
+	var configureEnv []string
+	for k, v := range pkg.ConfigureEnv {
+		configureEnv = append(configureEnv, fmt.Sprintf("%s=%s", k, expand(v)))
+	}
+	configure := wrap(append([]string{"./configure"}, cmds.configureArgs...)...)
+	if len(configureEnv) > 0 {
+		configure = shellJoin(configureEnv) + " " + configure
+	}
+	if pkg.ConfigureDir != "" {
+		sw.line("cd \"$srcdir\"/%s", shellQuote(pkg.ConfigureDir))
+	}
+	if cmds.prefixStyle == PrefixStyleConfigure {
+		sw.line("[ -x ./configure ] || chmod +x ./configure")
+		sw.line("%s", configure)
+	} else {
+		sw.line("if [ -e ./configure ]; then [ -x ./configure ] || chmod +x ./configure; %s; fi", configure)
+	}
+
+	if buildDir != pkg.ConfigureDir {
+		sw.line("cd \"$srcdir\"/%s", shellQuote(buildDir))
+	}
+	sw.line("%s", wrap("make", fmt.Sprintf("-j%d", bu.opts.MakeJobs)))
+
+	umask, err := profile.umask()
+	if err != nil {
+		return err
+	}
+	if umask >= 0 {
+		sw.line("umask %03o", umask)
+	}
+	sw.line("%s", wrap(append([]string{"make"}, cmds.installArgs...)...))
+	sw.line(")")
+	scriptInstallCheck(sw, pkg, prefix)
+	return nil
+}
+
+func scriptInstallCheck(sw *scriptWriter, pkg *Package, prefix string) {
+	for _, p := range pkg.InstallCheck {
+		path := shellQuote(filepath.Join(prefix, p))
+		sw.line("[ -e %s ] || { echo %s >&2; exit 1; }", path, shellQuote(p+" not found after install"))
+	}
+}
+
+// scriptDownload writes the commands to download pkg's archive to dest,
+// trying mirrors in turn, and to verify its checksum
+func (bu *build) scriptDownload(sw *scriptWriter, pkg *Package, dest string) {
+	if len(pkg.ResolverCommand) > 0 {
+		var attempts []string
+		for _, url := range append([]string{pkg.Sources}, pkg.Mirrors...) {
+			attempts = append(attempts, shellJoin(resolverArgs(pkg, url, dest)))
+		}
+		sw.line("%s", strings.Join(attempts, " || "))
+		scriptChecksum(sw, pkg, dest)
+		return
+	}
+
+	var curlArgs []string
+	if pkg.Auth != nil {
+		// secrets stay as ${VAR} references, for the shell to expand
+		switch {
+		case pkg.Auth.Username != "":
+			curlArgs = append(curlArgs, "-u", shellQuoteVars(pkg.Auth.Username+":"+pkg.Auth.Password))
+		case pkg.Auth.Token != "" && pkg.Auth.Header != "":
+			curlArgs = append(curlArgs, "-H", shellQuoteVars(pkg.Auth.Header+": "+pkg.Auth.Token))
+		case pkg.Auth.Token != "":
+			curlArgs = append(curlArgs, "-H", shellQuoteVars("Authorization: Bearer "+pkg.Auth.Token))
+		}
+	}
+
+	var attempts []string
+	for _, url := range append([]string{pkg.Sources}, pkg.Mirrors...) {
+		attempt := append([]string{"curl", "-fL", "-o", shellQuote(dest)}, curlArgs...)
+		attempt = append(attempt, shellQuote(url))
+		attempts = append(attempts, strings.Join(attempt, " "))
+	}
+	sw.line("%s", strings.Join(attempts, " || "))
+	scriptChecksum(sw, pkg, dest)
+}
+
+// scriptChecksum verifies the archive at dest, if the package has a
+// checksum
+func scriptChecksum(sw *scriptWriter, pkg *Package, dest string) {
+	if pkg.Checksum == "" {
+		return
+	}
+
+	algo := "sha256"
+	digest := pkg.Checksum
+	if i := strings.Index(pkg.Checksum, ":"); i >= 0 {
+		algo = pkg.Checksum[:i]
+		digest = pkg.Checksum[i+1:]
+	}
+	sw.line("echo %s | %ssum -c -", shellQuote(strings.ToLower(digest)+"  "+dest), algo)
+}
+
+// scriptTar is the tar scripts are written for
+var scriptTar = &tarTool{path: "tar", flavor: tarFlavorGNU}
+
+// scriptUntar returns the command extracting archive into dir, piping
+// it through the format's decompressor if it has one
+func (bu *build) scriptUntar(format string, archive string, dir string, strip int, include []string, exclude []string) (string, error) {
+	decompressor := bu.decompressor(format)
+	if decompressor == nil {
+		args, err := scriptTar.extractArgs(format, archive, dir, strip, include, exclude)
+		if err != nil {
+			return "", err
+		}
+		return shellJoin(append([]string{"tar"}, args...)), nil
+	}
+
+	args, err := scriptTar.extractArgs("tar", "-", dir, strip, include, exclude)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s < %s | %s", shellJoin(decompressor), shellQuote(archive), shellJoin(append([]string{"tar"}, args...))), nil
+}
+
+type scriptWriter struct {
+	w *bufio.Writer
+}
+
+func (sw *scriptWriter) line(format string, args ...interface{}) {
+	fmt.Fprintf(sw.w, format, args...)
+	sw.w.WriteString("\n")
+}
+
+func (sw *scriptWriter) command(exe string, args ...string) {
+	sw.line("%s", shellJoin(append([]string{exe}, args...)))
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s so that the shell takes it literally
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuoteVars quotes s for the shell, leaving ${VAR} references
+// (the kind Auth values use) for it to expand
+func shellQuoteVars(s string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	return `"` + escaper.Replace(s) + `"`
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
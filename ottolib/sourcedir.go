@@ -0,0 +1,120 @@
+package ottolib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fetchFromSourceDir finds a package's archive in the SourceDir given in
+// the build options and puts it at dest. Archives are looked up by their
+// usual name (or the one in the dir's manifest, if any), then by the
+// basename of their URL and, if the package has a checksum, by content.
+// Files whose checksum doesn't match are skipped, in case the right one
+// is there under another name.
+func (bu *build) fetchFromSourceDir(pkg *Package, dest string) error {
+	dir := bu.opts.SourceDir
+	candidates := []string{filepath.Base(dest)}
+	if manifest, err := ReadManifest(dir); err == nil {
+		for _, entry := range manifest.Packages {
+			if entry.Name == pkg.Name {
+				candidates = append([]string{entry.File}, candidates...)
+			}
+		}
+	}
+	if u, err := url.Parse(pkg.Sources); err == nil {
+		base := path.Base(u.Path)
+		if base != "." && base != "/" {
+			candidates = append(candidates, base)
+		}
+	}
+
+	var rejected []string
+	for _, name := range candidates {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+
+		err := bu.verifyChecksum(p, pkg.Checksum)
+		if err != nil {
+			bu.logger.Warnf("Skipping %s from source dir: %s", p, err)
+			rejected = append(rejected, name)
+			continue
+		}
+
+		bu.logger.Infof("Using %s from source dir", p)
+		return linkOrCopy(p, dest)
+	}
+
+	if pkg.Checksum != "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+
+			p := filepath.Join(dir, f.Name())
+			matches, err := checksumMatches(p, pkg.Checksum)
+			if err != nil {
+				return err
+			}
+
+			if matches {
+				bu.logger.Infof("Using %s from source dir (matched by checksum)", p)
+				return linkOrCopy(p, dest)
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		return fmt.Errorf("no archive for %s in source dir %s matches its checksum (%s didn't)", pkg.Name, dir, strings.Join(rejected, ", "))
+	}
+	return fmt.Errorf("no archive for %s in source dir %s (looked for %v)", pkg.Name, dir, candidates)
+}
+
+// linkOrCopy hardlinks src to dest, falling back to a copy
+// when they're not on the same filesystem
+func linkOrCopy(src string, dest string) error {
+	err := os.Remove(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if os.Link(src, dest) == nil {
+		return nil
+	}
+
+	return copyFile(src, dest)
+}
+
+// copyFile copies src to dest, replacing it
+func copyFile(src string, dest string) error {
+	reader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
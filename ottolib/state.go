@@ -0,0 +1,133 @@
+package ottolib
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// StateFile is the name of the state file otto keeps in each
+// profile's source directory
+const StateFile = "state.json"
+
+// State is what otto remembers about a profile between runs
+type State struct {
+	// Extracted maps package names (and their extra sources) to what
+	// their archive had in it the last time it was extracted
+	Extracted map[string]*ExtractRecord
+	// Timings maps package names to how long they last took to
+	// download and build, in seconds
+	Timings map[string]float64
+	// Owners maps the files in the prefix, relative to it, to the
+	// package that last installed them
+	Owners map[string]string
+	// Fingerprint is the build environment the profile was last built
+	// in, see EnvFingerprint
+	Fingerprint *EnvFingerprint `json:",omitempty"`
+}
+
+// ExtractRecord describes the contents of an extracted archive
+type ExtractRecord struct {
+	// Archive is the sha256 checksum of the archive
+	Archive string
+	// Files is the number of regular files in the archive
+	Files int
+	// Size is their total uncompressed size, in bytes
+	Size int64
+}
+
+func readState(src string) (*State, error) {
+	state := &State{}
+	err := readJSONFile(filepath.Join(src, StateFile), state)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("while reading state: %w", err)
+	}
+	if state.Extracted == nil {
+		state.Extracted = make(map[string]*ExtractRecord)
+	}
+	if state.Timings == nil {
+		state.Timings = make(map[string]float64)
+	}
+	if state.Owners == nil {
+		state.Owners = make(map[string]string)
+	}
+	return state, nil
+}
+
+func (bu *build) writeState(src string) error {
+	bu.stateLock.Lock()
+	defer bu.stateLock.Unlock()
+
+	_, err := writeJSONFile(filepath.Join(src, StateFile), bu.state, bu.opts.PlainJSON)
+	if err != nil {
+		return fmt.Errorf("while writing state: %w", err)
+	}
+	return nil
+}
+
+func (bu *build) recordTiming(pkg *Package, res *PackageResult) {
+	bu.stateLock.Lock()
+	defer bu.stateLock.Unlock()
+
+	bu.state.Timings[pkg.Name] = res.Duration.Seconds()
+}
+
+// verifyExtracted compares what's in an archive with what was in it
+// the last time, if it's the same archive. An archive with no files is
+// always suspicious: it's usually an HTML error page served as a 200.
+func (bu *build) verifyExtracted(name string, format string, archive string) error {
+	digest, err := computeChecksum(archive, "sha256")
+	if err != nil {
+		return err
+	}
+
+	files, size, err := bu.archiveStats(format, archive)
+	if err != nil {
+		return fmt.Errorf("while listing %s: %w", archive, err)
+	}
+	if files == 0 {
+		return fmt.Errorf("%s has no files in it", archive)
+	}
+
+	rec := &ExtractRecord{
+		Archive: "sha256:" + digest,
+		Files:   files,
+		Size:    size,
+	}
+
+	bu.stateLock.Lock()
+	defer bu.stateLock.Unlock()
+
+	previous := bu.state.Extracted[name]
+	if previous != nil && previous.Archive == rec.Archive {
+		if previous.Files != rec.Files || previous.Size != rec.Size {
+			return fmt.Errorf("%s has %d files (%s), expected %d files (%s) from the last extraction",
+				archive, rec.Files, humanize.IBytes(uint64(rec.Size)), previous.Files, humanize.IBytes(uint64(previous.Size)))
+		}
+		bu.logger.Infof("Archive has %d files (%s), as expected", rec.Files, humanize.IBytes(uint64(rec.Size)))
+		return nil
+	}
+
+	bu.logger.Infof("Archive has %d files (%s), recording for next time", rec.Files, humanize.IBytes(uint64(rec.Size)))
+	bu.state.Extracted[name] = rec
+	return nil
+}
+
+// archiveStats counts the regular files in an archive and adds up their size
+func (bu *build) archiveStats(format string, archive string) (int, int64, error) {
+	var files int
+	var size int64
+	err := bu.scanArchive(format, archive, func(hdr *tar.Header) {
+		if hdr.Typeflag == tar.TypeReg {
+			files++
+			size += hdr.Size
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return files, size, nil
+}
@@ -0,0 +1,43 @@
+package ottolib
+
+import "fmt"
+
+// defaultShell runs build steps given as shell scripts
+const defaultShell = "/bin/sh"
+
+// runBuildSteps builds a package with its BuildSteps, each in its own
+// phase, in dir
+func (bu *build) runBuildSteps(pkg *Package, prep *prepared, dir string, prefix string, res *PackageResult) error {
+	shell := pkg.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+
+	for i, step := range pkg.BuildSteps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+
+		err := res.phase(name, func() error {
+			bu.logger.Infof("Running %s...", name)
+			if step.Shell != "" {
+				// $PREFIX is in the environment, the shell expands it
+				res.ran(shell, "-c", step.Shell)
+				return bu.buildCommand(dir, prefix, shell, prep.env, "-c", step.Shell)
+			}
+
+			args := make([]string, len(step.Args))
+			for j, arg := range step.Args {
+				args[j] = prep.expand(arg)
+			}
+			res.ran(args[0], args[1:]...)
+			return bu.buildCommand(dir, prefix, args[0], prep.env, args[1:]...)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package ottolib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// packageStore is where packages are installed with StoreDir: each in
+// its own prefix, <store>/<hash>-<name>, named by a hash of everything
+// that goes into building it. A package whose store path is complete
+// is never built again.
+type packageStore struct {
+	dir     string
+	config  *Config
+	profile *Profile
+	hashes  map[string]string
+}
+
+// storeInputs is what a store path's hash is computed from
+type storeInputs struct {
+	Profile *Profile
+	Package *Package
+	// Deps are the hashes of the package's deps, so that rebuilding a
+	// dep rebuilds its dependents
+	Deps []string
+}
+
+func newStore(dir string, config *Config, profile *Profile) (*packageStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("while absolutizing store dir: %w", err)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("while creating store dir: %w", err)
+	}
+
+	return &packageStore{
+		dir:     dir,
+		config:  config,
+		profile: profile,
+		hashes:  make(map[string]string),
+	}, nil
+}
+
+// inputs returns what pkg's hash is computed from. The profile's name
+// and prefix don't change what's built, so profiles that only differ
+// by those share store paths.
+func (s *packageStore) inputs(pkg *Package) *storeInputs {
+	profile := *s.profile
+	profile.Name = ""
+	profile.Prefix = ""
+
+	inputs := &storeInputs{Profile: &profile, Package: pkg}
+	for _, dep := range pkg.allDeps() {
+		if depPkg := s.config.Package(dep); depPkg != nil {
+			inputs.Deps = append(inputs.Deps, s.hash(depPkg))
+		}
+	}
+	return inputs
+}
+
+func (s *packageStore) hash(pkg *Package) string {
+	if h, ok := s.hashes[pkg.Name]; ok {
+		return h
+	}
+
+	// packages and profiles always marshal, they come from JSON
+	payload, _ := json.Marshal(s.inputs(pkg))
+	sum := sha256.Sum256(payload)
+	h := hex.EncodeToString(sum[:16])
+	s.hashes[pkg.Name] = h
+	return h
+}
+
+// path is where pkg gets installed
+func (s *packageStore) path(pkg *Package) string {
+	return filepath.Join(s.dir, s.hash(pkg)+"-"+pkg.Name)
+}
+
+// completePath returns pkg's store path if it was completely built,
+// or ""
+func (s *packageStore) completePath(pkg *Package) string {
+	p := s.path(pkg)
+	if _, err := os.Stat(p + ".done"); err != nil {
+		return ""
+	}
+	return p
+}
+
+// depPaths are the store paths of everything pkg (transitively)
+// depends on, in dependency order. Builds only see those.
+func (s *packageStore) depPaths(pkg *Package) ([]string, error) {
+	deps, err := resolveDeps(s.config, pkg.allDeps())
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, dep := range deps {
+		paths = append(paths, s.path(dep))
+	}
+	return paths, nil
+}
+
+// buildInStore builds pkg into its store path with f, holding a lock on it so
+// that several otto processes can share a store. Partial builds are
+// removed first, and the path is marked complete once f succeeds.
+func (bu *build) buildInStore(s *packageStore, pkg *Package, f func() error) error {
+	p := s.path(pkg)
+
+	lock, err := lockFile(p + ".lock")
+	if err != nil {
+		return fmt.Errorf("while locking %s: %w", p, err)
+	}
+	defer lock.Close()
+
+	if s.completePath(pkg) != "" {
+		bu.logger.Infof("%s was built meanwhile, by another otto", p)
+		return nil
+	}
+
+	err = os.RemoveAll(p)
+	if err != nil {
+		return err
+	}
+
+	err = f()
+	if err != nil {
+		return err
+	}
+
+	// what went into the hash, for whoever wonders
+	payload, err := json.MarshalIndent(s.inputs(pkg), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p+".done", payload, 0644)
+}
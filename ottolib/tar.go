@@ -0,0 +1,92 @@
+package ottolib
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	tarFlavorGNU     = "GNU"
+	tarFlavorBSD     = "BSD"
+	tarFlavorUnknown = "unknown"
+)
+
+// tarTool is the tar binary a build extracts with, and what kind it is
+type tarTool struct {
+	path   string
+	flavor string
+}
+
+// findTar picks the tar binary to use: the one given, or else the first
+// of gtar, tar and bsdtar found in PATH. Its flavor is detected from
+// "tar --version", since GNU and BSD tar don't take quite the same flags.
+func findTar(name string) (*tarTool, error) {
+	candidates := []string{"gtar", "tar", "bsdtar"}
+	if name != "" {
+		candidates = []string{name}
+	}
+
+	for _, candidate := range candidates {
+		p, err := exec.LookPath(candidate)
+		if err != nil {
+			continue
+		}
+
+		t := &tarTool{path: p, flavor: tarFlavorUnknown}
+		out, _ := exec.Command(p, "--version").Output()
+		version := string(out)
+		switch {
+		case strings.Contains(version, "GNU tar"):
+			t.flavor = tarFlavorGNU
+		case strings.Contains(version, "bsdtar"):
+			t.flavor = tarFlavorBSD
+		}
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("no tar found in PATH (looked for %s)", strings.Join(candidates, ", "))
+}
+
+// extractArgs returns the args to extract archive (in format) into dir,
+// leaving out the first strip path components and filtering members
+// with include and exclude wildcards
+func (t *tarTool) extractArgs(format string, archive string, dir string, strip int, include []string, exclude []string) ([]string, error) {
+	args := []string{"-x", "-f", archive, "-C", dir}
+
+	// BSD tar always detects compression, GNU tar only does
+	// so in recent versions
+	switch format {
+	case "tar":
+	case "tar.gz":
+		if t.flavor == tarFlavorGNU {
+			args = append(args, "-z")
+		}
+	case "tar.xz":
+		if t.flavor == tarFlavorGNU {
+			args = append(args, "-J")
+		}
+	default:
+		return nil, fmt.Errorf("tar: unknown format %s (formats tar can't read need a command in the config's Decompressors)", format)
+	}
+
+	if t.flavor == tarFlavorUnknown && (strip > 0 || len(include) > 0 || len(exclude) > 0) {
+		return nil, fmt.Errorf("%s is neither GNU nor BSD tar, and may not support --strip-components, --exclude or wildcards (use --tar to pick another)", t.path)
+	}
+
+	if strip > 0 {
+		args = append(args, fmt.Sprintf("--strip-components=%d", strip))
+	}
+	for _, pattern := range exclude {
+		args = append(args, "--exclude="+pattern)
+	}
+	if len(include) > 0 {
+		// BSD tar matches members as patterns already
+		if t.flavor == tarFlavorGNU {
+			args = append(args, "--wildcards")
+		}
+		args = append(args, include...)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,160 @@
+package ottolib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type loadedPin struct {
+	pin   *Pin
+	roots *x509.CertPool
+}
+
+// newHTTPClient returns the client downloads go through, which
+// enforces pins when connecting to matching hosts, and the timeouts
+// and user agents of opts
+func newHTTPClient(pins []*Pin, opts DownloadOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	netDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if opts.ConnectTimeout > 0 {
+		netDialer.Timeout = opts.ConnectTimeout
+		transport.TLSHandshakeTimeout = opts.ConnectTimeout
+	}
+	transport.DialContext = netDialer.DialContext
+	// the body is watched by download itself, see stallReader
+	transport.ResponseHeaderTimeout = opts.ReadTimeout
+
+	if len(pins) == 0 {
+		return &http.Client{Transport: withUserAgent(transport, opts)}, nil
+	}
+
+	var loaded []*loadedPin
+	for _, pin := range pins {
+		lp := &loadedPin{pin: pin}
+		if pin.CABundle != "" {
+			pem, err := ioutil.ReadFile(pin.CABundle)
+			if err != nil {
+				return nil, fmt.Errorf("while reading CA bundle for %s: %w", pin.Host, err)
+			}
+
+			lp.roots = x509.NewCertPool()
+			if !lp.roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", pin.CABundle)
+			}
+		}
+		loaded = append(loaded, lp)
+	}
+
+	pinned := &pinnedTransport{
+		base:   transport,
+		pins:   loaded,
+		byHost: make(map[string]*http.Transport),
+	}
+	return &http.Client{Transport: withUserAgent(pinned, opts)}, nil
+}
+
+// pinnedTransport sends https requests through a transport of their
+// host's own, whose TLS config verifies the server against that host.
+// The host has to come from the request: the handshake's ServerName is
+// empty for IP addresses, and a custom dialer isn't used for
+// connections made through a proxy. Each transport only connects to its
+// host, so it's checked on every handshake, proxied or not.
+type pinnedTransport struct {
+	base *http.Transport
+	pins []*loadedPin
+
+	lock   sync.Mutex
+	byHost map[string]*http.Transport
+}
+
+func (pt *pinnedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return pt.base.RoundTrip(req)
+	}
+	host := req.URL.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("no host to verify the certificate of in %s", req.URL)
+	}
+	return pt.forHost(host).RoundTrip(req)
+}
+
+func (pt *pinnedTransport) forHost(host string) *http.Transport {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	if transport, ok := pt.byHost[host]; ok {
+		return transport
+	}
+	transport := pt.base.Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// verifyPeer does what it would, with the pinned roots
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPeer(pt.pins, host, cs)
+		},
+	}
+	pt.byHost[host] = transport
+	return transport
+}
+
+// verifyPeer verifies the certificate chain a server presented for host
+// (a name or an IP address), against the roots of the pin matching it
+// (or the system's if there's none, or it has no CABundle), and the
+// pin's fingerprint if it has one
+func verifyPeer(pins []*loadedPin, host string, cs tls.ConnectionState) error {
+	if host == "" {
+		return fmt.Errorf("no host to verify the certificate against")
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%s presented no certificate", host)
+	}
+
+	lp := matchPin(pins, host)
+	verifyOpts := x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	if lp != nil {
+		verifyOpts.Roots = lp.roots
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		verifyOpts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(verifyOpts)
+	if err != nil {
+		return err
+	}
+
+	if lp == nil || lp.pin.CertSHA256 == "" {
+		return nil
+	}
+	expected := strings.ToLower(lp.pin.CertSHA256)
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	actual := hex.EncodeToString(sum[:])
+	if actual != expected {
+		return fmt.Errorf("certificate for %s doesn't match pin: expected %s, got %s", host, expected, actual)
+	}
+	return nil
+}
+
+func matchPin(pins []*loadedPin, host string) *loadedPin {
+	for _, lp := range pins {
+		if ok, _ := path.Match(lp.pin.Host, host); ok {
+			return lp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// toolSpec is a tool a package requires, with an optional version
+// constraint, parsed from "cmake" or "cmake>=3.20"
+type toolSpec struct {
+	name    string
+	op      string
+	version string
+}
+
+var toolConstraint = regexp.MustCompile(`^([^<>=!\s]+)\s*(>=|<=|==|!=|=|>|<)\s*([0-9][0-9A-Za-z.]*)$`)
+
+func parseToolSpec(spec string) (*toolSpec, error) {
+	spec = strings.TrimSpace(spec)
+	if m := toolConstraint.FindStringSubmatch(spec); m != nil {
+		return &toolSpec{name: m[1], op: m[2], version: m[3]}, nil
+	}
+	if spec == "" || strings.ContainsAny(spec, "<>=! ") {
+		return nil, fmt.Errorf("invalid tool requirement %q, expected a tool name with an optional version constraint like cmake>=3.20", spec)
+	}
+	return &toolSpec{name: spec}, nil
+}
+
+func (ts *toolSpec) String() string {
+	if ts.op == "" {
+		return ts.name
+	}
+	return ts.name + ts.op + ts.version
+}
+
+// versionTimeout is how long a tool can take to print its version
+const versionTimeout = 30 * time.Second
+
+// checkTool makes sure the tool described by spec is in the PATH of
+// env and, if spec has a version constraint, that the version it
+// reports with --version satisfies it
+func (bu *build) checkTool(spec string, env []string) error {
+	ts, err := parseToolSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	p, err := lookPath(ts.name, env)
+	if err != nil {
+		return err
+	}
+	if ts.op == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(bu.ctx, versionTimeout)
+	defer cancel()
+
+	// some tools print their version on stderr
+	cmd := exec.CommandContext(ctx, p, "--version")
+	cmd.Env = mergeEnv(nil, env)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("while running %s --version: %w", p, err)
+	}
+
+	version := findVersion(string(out))
+	if version == "" {
+		return fmt.Errorf("couldn't find a version in the output of %s --version", p)
+	}
+	bu.logger.Debugf("%s is version %s", p, version)
+
+	if !versionSatisfies(version, ts.op, ts.version) {
+		return fmt.Errorf("%s is version %s, but %s is required", p, version, ts)
+	}
+	return nil
+}
+
+var (
+	dottedVersion = regexp.MustCompile(`\b[0-9]+(\.[0-9]+)+`)
+	plainVersion  = regexp.MustCompile(`\b[0-9]+\b`)
+)
+
+// findVersion finds the version in the output of some --version, which
+// comes in many shapes: "cmake version 3.22.1", "autoconf (GNU Autoconf)
+// 2.71", "gcc (Ubuntu 11.4.0-1ubuntu1~22.04) 11.4.0", "GNU Make 4.3"...
+// The first dotted number is usually it, otherwise the first number.
+func findVersion(out string) string {
+	if v := dottedVersion.FindString(out); v != "" {
+		return v
+	}
+	return plainVersion.FindString(out)
+}
+
+// compareVersions compares dotted versions numerically, component by
+// component, missing ones counting as 0. Non-numeric suffixes (as in
+// "1.2rc1") are ignored.
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+func versionSatisfies(version string, op string, wanted string) bool {
+	c := compareVersions(version, wanted)
+	switch op {
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	case "<":
+		return c < 0
+	case "!=":
+		return c != 0
+	default:
+		return c == 0
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package ottolib
+
+import "syscall"
+
+// withUmask runs f with the process umask set to mask, and restores
+// the previous one afterwards. Commands started by f inherit it.
+func withUmask(mask int, f func() error) error {
+	previous := syscall.Umask(mask)
+	defer syscall.Umask(previous)
+	return f()
+}
@@ -0,0 +1,6 @@
+package ottolib
+
+// withUmask just runs f, there's no umask on Windows
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -0,0 +1,302 @@
+package ottolib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// decompress wraps r so that it reads the tarball inside an archive
+// of the given format
+func decompress(format string, r io.Reader) (io.Reader, error) {
+	switch format {
+	case "tar":
+		return r, nil
+	case "tar.gz":
+		return gzip.NewReader(r)
+	case "tar.xz":
+		return xz.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unknown format %s (formats otto can't read need a command in the config's Decompressors)", format)
+	}
+}
+
+// scanArchive calls f with the header of every member of an archive
+func (bu *build) scanArchive(format string, archive string, f func(hdr *tar.Header)) error {
+	r, done, err := bu.openArchive(format, archive)
+	if err != nil {
+		return err
+	}
+
+	err = scanTarball(tar.NewReader(r), f)
+	doneErr := done()
+	if err != nil {
+		return err
+	}
+	return doneErr
+}
+
+func scanTarball(tr *tar.Reader, f func(hdr *tar.Header)) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f(hdr)
+	}
+}
+
+// nativeExtract does what tar would do with the flags extract passes
+// it, but in Go, so that it behaves the same everywhere
+func (bu *build) nativeExtract(format string, archive string, dir string, strip int, include []string, exclude []string) error {
+	bu.logger.Infof("> (native) extract %s into %s", archive, dir)
+
+	r, done, err := bu.openArchive(format, archive)
+	if err != nil {
+		return err
+	}
+
+	err = extractTarball(tar.NewReader(r), archive, dir, strip, include, exclude)
+	doneErr := done()
+	if err != nil {
+		return err
+	}
+	return doneErr
+}
+
+// extractTarball is nativeExtract once the archive is decompressed.
+// Members can't end up outside of dir: not by their name, not through
+// a symlink extracted before them, and symlinks and hard links can't
+// point outside of it either.
+func extractTarball(tr *tar.Reader, archive string, dir string, strip int, include []string, exclude []string) error {
+	// the members extracted as symlinks so far, relative to dir
+	symlinks := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if !memberSelected(name, include, exclude) {
+			continue
+		}
+
+		rel, ok := stripComponents(name, strip)
+		if !ok {
+			continue
+		}
+		if outsideDest(rel) || crossesSymlink(rel, symlinks) {
+			return fmt.Errorf("%s: refusing to extract %s outside of the destination", archive, hdr.Name)
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(rel))
+
+		err = extractMember(tr, hdr, rel, dest, dir, strip, symlinks)
+		if err != nil {
+			return fmt.Errorf("while extracting %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// outsideDest reports whether a cleaned, slash-separated path relative
+// to the destination points outside of it
+func outsideDest(rel string) bool {
+	return path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../")
+}
+
+// crossesSymlink reports whether one of rel's parent directories is a
+// symlink extracted earlier, which writing to rel would then follow
+func crossesSymlink(rel string, symlinks map[string]bool) bool {
+	for parent := path.Dir(rel); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if symlinks[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkEscapes reports whether a symlink at rel pointing to target
+// would lead outside of the destination, going by the path alone.
+// Going through another symlink is refused too, since where that one
+// leads depends on what it resolves to.
+func symlinkEscapes(rel string, target string, symlinks map[string]bool) bool {
+	if path.IsAbs(target) {
+		return true
+	}
+
+	var cur []string
+	if parent := path.Dir(rel); parent != "." {
+		cur = strings.Split(parent, "/")
+	}
+	for _, component := range strings.Split(target, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		if len(cur) > 0 && symlinks[strings.Join(cur, "/")] {
+			return true
+		}
+		if component == ".." {
+			if len(cur) == 0 {
+				return true
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, component)
+	}
+	return false
+}
+
+func extractMember(tr *tar.Reader, hdr *tar.Header, rel string, dest string, dir string, strip int, symlinks map[string]bool) error {
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err := os.MkdirAll(dest, mode|0700)
+		if err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+
+		// like tar, replace whatever is there
+		os.Remove(dest)
+		delete(symlinks, rel)
+		w, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, tr)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if symlinkEscapes(rel, hdr.Linkname, symlinks) {
+			return fmt.Errorf("refusing to create a symlink to %s, outside of the destination", hdr.Linkname)
+		}
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		symlinks[rel] = true
+		return os.Symlink(hdr.Linkname, dest)
+	case tar.TypeLink:
+		// hard links name another member of the archive
+		target, ok := stripComponents(strings.TrimPrefix(path.Clean(hdr.Linkname), "./"), strip)
+		if !ok {
+			return fmt.Errorf("hard link to %s, which isn't extracted", hdr.Linkname)
+		}
+		if outsideDest(target) || crossesSymlink(target, symlinks) {
+			return fmt.Errorf("refusing to create a hard link to %s, outside of the destination", hdr.Linkname)
+		}
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		// a hard link to a symlink is one too
+		symlinks[rel] = symlinks[target]
+		return os.Link(filepath.Join(dir, filepath.FromSlash(target)), dest)
+	default:
+		// devices, fifos and the like have no business in source archives
+		return nil
+	}
+
+	return os.Chtimes(dest, hdr.ModTime, hdr.ModTime)
+}
+
+// stripComponents removes the first n components of name, and reports
+// false if there's nothing left
+func stripComponents(name string, n int) (string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) <= n {
+		return "", false
+	}
+	return strings.Join(parts[n:], "/"), true
+}
+
+// memberSelected reports whether an archive member is to be extracted,
+// given tar-style include and exclude wildcards. Like with GNU tar,
+// "*" matches slashes too, and excludes without a slash match any
+// path component.
+func memberSelected(name string, include []string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if wildcardMatch(pattern, name) {
+			return false
+		}
+		if !strings.Contains(pattern, "/") {
+			for _, component := range strings.Split(name, "/") {
+				if wildcardMatch(pattern, component) {
+					return false
+				}
+			}
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		// directories leading to selected members are
+		// created as needed, no need to match those
+		if wildcardMatch(pattern, name) || wildcardMatch(pattern, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func wildcardMatch(pattern string, name string) bool {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				re.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	matched, err := regexp.MatchString(re.String(), name)
+	return err == nil && matched
+}
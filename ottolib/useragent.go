@@ -0,0 +1,48 @@
+package ottolib
+
+import (
+	"net/http"
+	"path"
+)
+
+// DefaultUserAgent is what downloads identify as when DownloadOptions
+// doesn't say otherwise
+const DefaultUserAgent = "otto"
+
+// userAgentTransport sets the User-Agent of every request that goes
+// through it, since some hosts block Go's default one
+type userAgentTransport struct {
+	base http.RoundTripper
+	// userAgent is the default, hosts maps host patterns (as in pins)
+	// to overrides
+	userAgent string
+	hosts     map[string]string
+}
+
+func withUserAgent(base http.RoundTripper, opts DownloadOptions) http.RoundTripper {
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	return &userAgentTransport{
+		base:      base,
+		userAgent: userAgent,
+		hosts:     opts.HostUserAgents,
+	}
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't modify the request they're given
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.forHost(req.URL.Hostname()))
+	return t.base.RoundTrip(req)
+}
+
+func (t *userAgentTransport) forHost(host string) string {
+	for pattern, userAgent := range t.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return userAgent
+		}
+	}
+	return t.userAgent
+}
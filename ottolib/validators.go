@@ -0,0 +1,59 @@
+package ottolib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// httpValidators are what a server told us about an archive we
+// downloaded, so that we can ask it whether it changed next time
+type httpValidators struct {
+	URL          string
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
+
+// validatorsPath is where the validators for the archive at dest are kept
+func validatorsPath(dest string) string {
+	return dest + ".http.json"
+}
+
+// readValidators returns the validators for the archive at dest, if it
+// was downloaded from url and is still there
+func readValidators(dest string, url string) *httpValidators {
+	if _, err := os.Stat(dest); err != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(validatorsPath(dest))
+	if err != nil {
+		return nil
+	}
+
+	var v httpValidators
+	if json.Unmarshal(data, &v) != nil || v.URL != url {
+		return nil
+	}
+	if v.ETag == "" && v.LastModified == "" {
+		return nil
+	}
+	return &v
+}
+
+func writeValidators(dest string, v *httpValidators) error {
+	if v.ETag == "" && v.LastModified == "" {
+		removeValidators(dest)
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(validatorsPath(dest), data, 0644)
+}
+
+func removeValidators(dest string) {
+	os.Remove(validatorsPath(dest))
+}
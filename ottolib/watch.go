@@ -0,0 +1,179 @@
+package ottolib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchOptions controls Builder.Watch
+type WatchOptions struct {
+	// Build is what's built first, and what rebuilds are taken from
+	Build BuildOptions
+	// Debounce is how long changes have to settle before rebuilding,
+	// half a second if zero
+	Debounce time.Duration
+	// Built, if set, is called after the first build and every rebuild
+	Built func(res *Result, err error)
+}
+
+// Watch builds like Build does, then watches the local sources (file://
+// URLs) of the packages it built, and rebuilds a package along with its
+// dependents whenever its sources change. Rebuilds skip deps, they were
+// built already. Failed builds don't stop it: only ctx being cancelled
+// or the watcher failing does.
+func (b *Builder) Watch(ctx context.Context, opts WatchOptions) error {
+	debounce := opts.Debounce
+	if debounce == 0 {
+		debounce = 500 * time.Millisecond
+	}
+	built := opts.Built
+	if built == nil {
+		built = func(*Result, error) {}
+	}
+	logger := b.Logger
+	if logger == nil {
+		logger = DiscardLogger()
+	}
+
+	plans, err := b.Plan(opts.Build)
+	if err != nil {
+		return err
+	}
+
+	// local path -> name of the package it belongs to
+	watched := make(map[string]string)
+	selected := make(map[string]bool)
+	for _, pp := range plans {
+		for _, d := range pp.Packages {
+			if !d.Build {
+				continue
+			}
+			selected[d.Package.Name] = true
+
+			all := []*Package{d.Package}
+			for i := range d.Package.ExtraSources {
+				all = append(all, d.Package.extraPackage(i))
+			}
+			for _, p := range all {
+				if local, ok := localPath(p.Sources); ok {
+					watched[filepath.Clean(local)] = d.Package.Name
+				}
+			}
+		}
+	}
+	if len(watched) == 0 {
+		return fmt.Errorf("none of the packages to build have local (file://) sources to watch")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("while starting to watch: %w", err)
+	}
+	defer watcher.Close()
+
+	for p := range watched {
+		err = watchPath(watcher, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := b.Build(ctx, opts.Build)
+	built(res, err)
+
+	changed := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-watcher.Errors:
+			return fmt.Errorf("while watching: %w", err)
+
+		case event := <-watcher.Events:
+			name := owner(watched, event.Name)
+			sep := string(filepath.Separator)
+			if name == "" || strings.Contains(event.Name+sep, sep+".git"+sep) {
+				continue
+			}
+
+			// new directories need watching too
+			if event.Op&fsnotify.Create != 0 {
+				if stats, err := os.Stat(event.Name); err == nil && stats.IsDir() {
+					watchPath(watcher, event.Name)
+				}
+			}
+
+			if !changed[name] {
+				logger.Infof("%s changed (%s)", name, event.Name)
+			}
+			changed[name] = true
+			timer.Reset(debounce)
+
+		case <-timer.C:
+			var names []string
+			for _, name := range b.Config.withDependents(changed) {
+				if selected[name] {
+					names = append(names, name)
+				}
+			}
+			changed = make(map[string]bool)
+
+			logger.Infof("Rebuilding %s", strings.Join(names, ", "))
+			rebuild := opts.Build
+			rebuild.Packages = names
+			rebuild.Tags = nil
+			rebuild.Resume = ""
+			rebuild.ResumeProfile = ""
+			rebuild.SkipDeps = true
+
+			res, err := b.Build(ctx, rebuild)
+			built(res, err)
+		}
+	}
+}
+
+// watchPath watches p and, if it's a directory, everything under it
+// (but .git) since fsnotify doesn't do that by itself. Files are watched
+// through their directory, so that editors saving by renaming work.
+func watchPath(watcher *fsnotify.Watcher, p string) error {
+	stats, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("while watching %s: %w", p, err)
+	}
+	if !stats.IsDir() {
+		return watcher.Add(filepath.Dir(p))
+	}
+
+	return filepath.Walk(p, func(sub string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		return watcher.Add(sub)
+	})
+}
+
+// owner returns the package the changed path belongs to, if any
+func owner(watched map[string]string, changed string) string {
+	for p, name := range watched {
+		if changed == p || strings.HasPrefix(changed, p+string(filepath.Separator)) {
+			return name
+		}
+	}
+	return ""
+}